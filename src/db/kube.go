@@ -0,0 +1,569 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	corev1client "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/util/retry"
+)
+
+const (
+	// LabelRecord marks the ConfigMaps holding instance records.
+	LabelRecord = "instanced.maplebacon.org/record"
+	// LabelRecordState is the state of the instance held by a record ConfigMap.
+	LabelRecordState = "instanced.maplebacon.org/state"
+
+	recordNamePrefix = "instanced-record-"
+	// counterName is the ConfigMap holding the next record id, so ids are not reused once records are pruned
+	counterName = "instanced-records"
+	counterKey  = "next-id"
+	// maxInsertAttempts bounds the retries of concurrent inserts racing for the same id
+	maxInsertAttempts = 5
+)
+
+// KubeStore is an InstanceStore keeping every record in its own ConfigMap, so no volume is needed.
+// Updates use the resourceVersion of the ConfigMap for optimistic concurrency.
+type KubeStore struct {
+	client    corev1client.ConfigMapInterface
+	namespace string
+}
+
+// NewKubeStore returns a store keeping records as ConfigMaps in namespace.
+func NewKubeStore(conf *rest.Config, namespace string) (*KubeStore, error) {
+	client, err := corev1client.NewForConfig(conf)
+	if err != nil {
+		return nil, err
+	}
+	return &KubeStore{
+		client:    client.ConfigMaps(namespace),
+		namespace: namespace,
+	}, nil
+}
+
+func recordName(id int64) string {
+	return fmt.Sprintf("%v%v", recordNamePrefix, id)
+}
+
+// encodeRecord returns the ConfigMap data holding rec.
+func encodeRecord(rec InstanceRecord) (map[string]string, error) {
+	endpoints := rec.Endpoints
+	if endpoints == nil {
+		endpoints = []Endpoint{}
+	}
+	kinds := rec.Kinds
+	if kinds == nil {
+		kinds = []ObjectKind{}
+	}
+	endpointsJSON, err := json.Marshal(endpoints)
+	if err != nil {
+		return nil, err
+	}
+	kindsJSON, err := json.Marshal(kinds)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]string{
+		"challenge":    rec.Challenge,
+		"team":         rec.TeamID,
+		"uuid":         rec.UUID,
+		"expiry":       strconv.FormatInt(rec.Expiry.Unix(), 10),
+		"created_at":   strconv.FormatInt(rec.Created.Unix(), 10),
+		"extensions":   strconv.Itoa(rec.Extensions),
+		"endpoints":    string(endpointsJSON),
+		"namespace":    rec.Namespace,
+		"isolated":     strconv.FormatBool(rec.Isolated),
+		"kinds":        string(kindsJSON),
+		"missing":      strconv.FormatBool(rec.Missing),
+		"state":        string(rec.State),
+		"error":        rec.Error,
+		"ready_at":     strconv.FormatInt(unixOrZeroInt(rec.ReadyAt), 10),
+		"destroyed_at": strconv.FormatInt(unixOrZeroInt(rec.DestroyedAt), 10),
+	}, nil
+}
+
+// decodeRecord parses the record held by a ConfigMap.
+func decodeRecord(cm *corev1.ConfigMap) (InstanceRecord, error) {
+	id, err := strconv.ParseInt(strings.TrimPrefix(cm.Name, recordNamePrefix), 10, 64)
+	if err != nil {
+		return InstanceRecord{}, fmt.Errorf("invalid record name %q: %w", cm.Name, err)
+	}
+	d := cm.Data
+	rec := InstanceRecord{
+		Id:        id,
+		Challenge: d["challenge"],
+		TeamID:    d["team"],
+		UUID:      d["uuid"],
+		Namespace: d["namespace"],
+		State:     InstanceState(d["state"]),
+		Error:     d["error"],
+	}
+	var expiry, created, readyAt, destroyedAt int64
+	for key, dst := range map[string]*int64{"expiry": &expiry, "created_at": &created, "ready_at": &readyAt, "destroyed_at": &destroyedAt} {
+		*dst, err = strconv.ParseInt(d[key], 10, 64)
+		if err != nil {
+			return InstanceRecord{}, fmt.Errorf("could not parse %v of record %v: %w", key, id, err)
+		}
+	}
+	rec.Expiry = time.Unix(expiry, 0)
+	rec.Created = time.Unix(created, 0)
+	rec.ReadyAt = unixOrZero(readyAt)
+	rec.DestroyedAt = unixOrZero(destroyedAt)
+	rec.Extensions, err = strconv.Atoi(d["extensions"])
+	if err != nil {
+		return InstanceRecord{}, fmt.Errorf("could not parse extensions of record %v: %w", id, err)
+	}
+	rec.Isolated, err = strconv.ParseBool(d["isolated"])
+	if err != nil {
+		return InstanceRecord{}, fmt.Errorf("could not parse isolated of record %v: %w", id, err)
+	}
+	rec.Missing, err = strconv.ParseBool(d["missing"])
+	if err != nil {
+		return InstanceRecord{}, fmt.Errorf("could not parse missing of record %v: %w", id, err)
+	}
+	err = json.Unmarshal([]byte(d["endpoints"]), &rec.Endpoints)
+	if err != nil {
+		return InstanceRecord{}, fmt.Errorf("could not parse endpoints of record %v: %w", id, err)
+	}
+	err = json.Unmarshal([]byte(d["kinds"]), &rec.Kinds)
+	if err != nil {
+		return InstanceRecord{}, fmt.Errorf("could not parse kinds of record %v: %w", id, err)
+	}
+	rec.setUrl()
+	return rec, nil
+}
+
+// unixOrZeroInt is the inverse of unixOrZero.
+func unixOrZeroInt(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.Unix()
+}
+
+// recordConfigMap returns the ConfigMap holding rec.
+func (s *KubeStore) recordConfigMap(rec InstanceRecord) (*corev1.ConfigMap, error) {
+	data, err := encodeRecord(rec)
+	if err != nil {
+		return nil, err
+	}
+	return &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      recordName(rec.Id),
+			Namespace: s.namespace,
+			Labels: map[string]string{
+				LabelRecord:      "true",
+				LabelRecordState: string(rec.State),
+			},
+		},
+		Data: data,
+	}, nil
+}
+
+// list returns the records matching selector, sorted by id.
+func (s *KubeStore) list(ctx context.Context, selector string) ([]InstanceRecord, error) {
+	cms, err := s.client.List(ctx, metav1.ListOptions{LabelSelector: selector})
+	if err != nil {
+		return nil, err
+	}
+	records := make([]InstanceRecord, 0, len(cms.Items))
+	for i := range cms.Items {
+		rec, err := decodeRecord(&cms.Items[i])
+		if err != nil {
+			return records, err
+		}
+		records = append(records, rec)
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].Id < records[j].Id
+	})
+	return records, nil
+}
+
+// recordSelector matches every record ConfigMap.
+var recordSelector = labels.SelectorFromSet(labels.Set{LabelRecord: "true"}).String()
+
+// activeSelector matches every record which has not been destroyed.
+var activeSelector = fmt.Sprintf("%v,%v!=%v", recordSelector, LabelRecordState, StateDestroyed)
+
+// nextID returns the next record id held by the counter ConfigMap, creating the counter after the highest
+// existing id if there is none. Stores created before the counter existed still have all of their records.
+func (s *KubeStore) nextID(ctx context.Context) (int64, error) {
+	for {
+		cm, err := s.client.Get(ctx, counterName, metav1.GetOptions{})
+		if err == nil {
+			return strconv.ParseInt(cm.Data[counterKey], 10, 64)
+		}
+		if !apierrors.IsNotFound(err) {
+			return 0, err
+		}
+
+		all, err := s.list(ctx, recordSelector)
+		if err != nil {
+			return 0, err
+		}
+		var next int64 = 1
+		if len(all) > 0 {
+			next = all[len(all)-1].Id + 1
+		}
+		_, err = s.client.Create(ctx, &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: counterName, Namespace: s.namespace},
+			Data:       map[string]string{counterKey: strconv.FormatInt(next, 10)},
+		}, metav1.CreateOptions{})
+		if err == nil {
+			return next, nil
+		}
+		// Another replica created the counter first
+		if !apierrors.IsAlreadyExists(err) {
+			return 0, err
+		}
+	}
+}
+
+// advanceCounter moves the next record id past id, unless another insert already did.
+func (s *KubeStore) advanceCounter(ctx context.Context, id int64) error {
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		cm, err := s.client.Get(ctx, counterName, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		next, err := strconv.ParseInt(cm.Data[counterKey], 10, 64)
+		if err != nil {
+			return err
+		}
+		if next > id {
+			return nil
+		}
+		cm.Data[counterKey] = strconv.FormatInt(id+1, 10)
+		// The resourceVersion read is sent back, so the update fails if the counter changed meanwhile
+		_, err = s.client.Update(ctx, cm, metav1.UpdateOptions{})
+		return err
+	})
+}
+
+// InsertInstanceRecord stores a new instance described by rec which expires after ttl.
+// The id is taken from the counter, which is advanced once the record ConfigMap is created. Inserts racing for the
+// same id are serialized by the creation of its ConfigMap, so the loser rechecks duplicates and quotas against the
+// records of the winner. A counter left behind by a failed insert is advanced past the existing record.
+func (s *KubeStore) InsertInstanceRecord(ctx context.Context, ttl time.Duration, rec InstanceRecord, quotas Quotas) (InstanceRecord, error) {
+	rec.State = StateProvisioning
+	rec.Created = time.Now()
+	rec.Expiry = rec.Created.Add(ttl)
+	if rec.Endpoints == nil {
+		rec.Endpoints = []Endpoint{}
+	}
+	if rec.Kinds == nil {
+		rec.Kinds = []ObjectKind{}
+	}
+
+	for attempt := 0; attempt < maxInsertAttempts; attempt++ {
+		// The id is read before the records, so a record created with an earlier id is seen
+		id, err := s.nextID(ctx)
+		if err != nil {
+			return InstanceRecord{}, err
+		}
+		active, err := s.list(ctx, activeSelector)
+		if err != nil {
+			return InstanceRecord{}, err
+		}
+		err = checkActiveRecords(active, rec.TeamID, rec.Challenge, quotas)
+		if err != nil {
+			return InstanceRecord{}, err
+		}
+		rec.Id = id
+		cm, err := s.recordConfigMap(rec)
+		if err != nil {
+			return InstanceRecord{}, err
+		}
+		_, err = s.client.Create(ctx, cm, metav1.CreateOptions{})
+		if apierrors.IsAlreadyExists(err) {
+			err = s.advanceCounter(ctx, id)
+			if err != nil {
+				return InstanceRecord{}, err
+			}
+			continue
+		}
+		if err != nil {
+			return InstanceRecord{}, err
+		}
+		err = s.advanceCounter(ctx, id)
+		if err != nil {
+			return InstanceRecord{}, fmt.Errorf("created record %v but could not advance the id counter: %w", id, err)
+		}
+		rec.setUrl()
+		return rec, nil
+	}
+	return InstanceRecord{}, fmt.Errorf("could not allocate a record id after %v attempts", maxInsertAttempts)
+}
+
+// checkActiveRecords returns a DuplicateInstanceError if a team already has an active instance of a challenge
+// among records, or a QuotaExceededError if another active instance would exceed a quota.
+func checkActiveRecords(records []InstanceRecord, team string, challenge string, quotas Quotas) error {
+	var teamCount, challengeCount, clusterCount int
+	for _, r := range records {
+		// Failed instances do not hold a slot, so a team can create the challenge again after a failed deploy
+		if r.State == StateFailed {
+			continue
+		}
+		if r.TeamID == team && r.Challenge == challenge {
+			return &DuplicateInstanceError{r}
+		}
+		clusterCount++
+		if r.TeamID == team {
+			teamCount++
+		}
+		if r.Challenge == challenge {
+			challengeCount++
+		}
+	}
+	return quotas.check(teamCount, challengeCount, clusterCount)
+}
+
+// update applies fn to the record with id and writes it back, retrying if the ConfigMap changed concurrently.
+// Errors returned by fn abort the update.
+func (s *KubeStore) update(ctx context.Context, id int64, fn func(rec *InstanceRecord) error) (InstanceRecord, error) {
+	var res InstanceRecord
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		cm, err := s.client.Get(ctx, recordName(id), metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			return fmt.Errorf("no record with id %v: %w", id, ErrNotFound)
+		}
+		if err != nil {
+			return err
+		}
+		rec, err := decodeRecord(cm)
+		if err != nil {
+			return err
+		}
+		err = fn(&rec)
+		if err != nil {
+			return err
+		}
+		updated, err := s.recordConfigMap(rec)
+		if err != nil {
+			return err
+		}
+		updated.ResourceVersion = cm.ResourceVersion
+		_, err = s.client.Update(ctx, updated, metav1.UpdateOptions{})
+		if err != nil {
+			return err
+		}
+		res = rec
+		return nil
+	})
+	return res, err
+}
+
+// ExtendInstanceRecord sets the expiry of an instance and increments its extension count.
+// The update only applies while the instance is provisioning or ready, otherwise ErrStateConflict is returned,
+// and while it has fewer than maxExtensions extensions, otherwise ErrExtensionLimit is returned.
+func (s *KubeStore) ExtendInstanceRecord(ctx context.Context, id int64, expiry time.Time, maxExtensions int) (InstanceRecord, error) {
+	return s.update(ctx, id, func(rec *InstanceRecord) error {
+		if rec.State != StateProvisioning && rec.State != StateReady {
+			return fmt.Errorf("instance %v is %v: %w", id, rec.State, ErrStateConflict)
+		}
+		if rec.Extensions >= maxExtensions {
+			return ErrExtensionLimit
+		}
+		rec.Expiry = expiry
+		rec.Extensions++
+		return nil
+	})
+}
+
+// UpdateInstanceState moves an instance from state from to state to, recording reason as its error.
+// The time an instance becomes ready or destroyed is recorded. ErrStateConflict is returned if the
+// instance is no longer in state from.
+func (s *KubeStore) UpdateInstanceState(ctx context.Context, id int64, from InstanceState, to InstanceState, reason string) (InstanceRecord, error) {
+	return s.update(ctx, id, func(rec *InstanceRecord) error {
+		if rec.State != from {
+			return fmt.Errorf("instance %v is not %v: %w", id, from, ErrStateConflict)
+		}
+		rec.State = to
+		rec.Error = reason
+		now := time.Unix(time.Now().Unix(), 0)
+		if to == StateReady {
+			rec.ReadyAt = now
+		}
+		if to == StateDestroyed {
+			rec.DestroyedAt = now
+		}
+		return nil
+	})
+}
+
+// RestartInstanceRecord moves an instance from state from back to provisioning to redeploy it,
+// replacing its expiry and object kinds and clearing its error. ErrStateConflict is returned if the
+// instance is no longer in state from.
+// A failed instance becomes active again, so its restart races for the next id like an insert: once the record
+// is restarted, a destroyed placeholder record claiming the id is created. If an insert or another restart claimed
+// the id first, the record is returned to failed and checked again against the records of the winner.
+func (s *KubeStore) RestartInstanceRecord(ctx context.Context, id int64, from InstanceState, expiry time.Time, kinds []ObjectKind, quotas Quotas) (InstanceRecord, error) {
+	restart := func(rec *InstanceRecord) error {
+		if rec.State != from {
+			return fmt.Errorf("instance %v is not %v: %w", id, from, ErrStateConflict)
+		}
+		rec.State = StateProvisioning
+		rec.Error = ""
+		rec.Missing = false
+		rec.Expiry = expiry
+		rec.Kinds = kinds
+		return nil
+	}
+	if from != StateFailed {
+		return s.update(ctx, id, restart)
+	}
+
+	for attempt := 0; attempt < maxInsertAttempts; attempt++ {
+		// The id is read before the records, so a record created with an earlier id is seen
+		next, err := s.nextID(ctx)
+		if err != nil {
+			return InstanceRecord{}, err
+		}
+		failed, err := s.ReadInstanceRecord(ctx, id)
+		if err != nil {
+			return InstanceRecord{}, err
+		}
+		if failed.State != from {
+			return InstanceRecord{}, fmt.Errorf("instance %v is not %v: %w", id, from, ErrStateConflict)
+		}
+		active, err := s.list(ctx, activeSelector)
+		if err != nil {
+			return InstanceRecord{}, err
+		}
+		err = checkActiveRecords(active, failed.TeamID, failed.Challenge, quotas)
+		if err != nil {
+			return InstanceRecord{}, err
+		}
+		restarted, err := s.update(ctx, id, restart)
+		if err != nil {
+			return InstanceRecord{}, err
+		}
+
+		now := time.Unix(time.Now().Unix(), 0)
+		cm, err := s.recordConfigMap(InstanceRecord{
+			Id:          next,
+			Challenge:   failed.Challenge,
+			TeamID:      failed.TeamID,
+			Created:     now,
+			State:       StateDestroyed,
+			Error:       fmt.Sprintf("id claimed by the restart of instance %v", id),
+			DestroyedAt: now,
+		})
+		if err == nil {
+			_, err = s.client.Create(ctx, cm, metav1.CreateOptions{})
+		}
+		if err != nil {
+			_, rerr := s.update(ctx, id, func(rec *InstanceRecord) error {
+				if rec.State != StateProvisioning {
+					return fmt.Errorf("instance %v is not %v: %w", id, StateProvisioning, ErrStateConflict)
+				}
+				rec.State = failed.State
+				rec.Error = failed.Error
+				rec.Missing = failed.Missing
+				rec.Expiry = failed.Expiry
+				rec.Kinds = failed.Kinds
+				return nil
+			})
+			if rerr != nil {
+				return InstanceRecord{}, fmt.Errorf("could not claim id %v for restart: %w, and could not return the record to failed: %w", next, err, rerr)
+			}
+			if !apierrors.IsAlreadyExists(err) {
+				return InstanceRecord{}, err
+			}
+			err = s.advanceCounter(ctx, next)
+			if err != nil {
+				return InstanceRecord{}, err
+			}
+			continue
+		}
+		err = s.advanceCounter(ctx, next)
+		if err != nil {
+			return InstanceRecord{}, fmt.Errorf("restarted record %v but could not advance the id counter: %w", id, err)
+		}
+		return restarted, nil
+	}
+	return InstanceRecord{}, fmt.Errorf("could not claim a record id for restart after %v attempts", maxInsertAttempts)
+}
+
+// SetInstanceMissing marks whether the objects of an instance are missing from the cluster.
+func (s *KubeStore) SetInstanceMissing(ctx context.Context, id int64, missing bool) error {
+	_, err := s.update(ctx, id, func(rec *InstanceRecord) error {
+		rec.Missing = missing
+		return nil
+	})
+	return err
+}
+
+// ReadInstanceRecord returns an instance in any state.
+func (s *KubeStore) ReadInstanceRecord(ctx context.Context, id int64) (InstanceRecord, error) {
+	cm, err := s.client.Get(ctx, recordName(id), metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return InstanceRecord{}, fmt.Errorf("no record with id %v: %w", id, ErrNotFound)
+	}
+	if err != nil {
+		return InstanceRecord{}, err
+	}
+	return decodeRecord(cm)
+}
+
+// ReadInstanceRecords returns every instance which has not been destroyed.
+func (s *KubeStore) ReadInstanceRecords(ctx context.Context) ([]InstanceRecord, error) {
+	return s.list(ctx, activeSelector)
+}
+
+// ReadInstanceRecordsTeam returns every instance of a team which has not been destroyed.
+// Team ids are not necessarily valid label values, so records are filtered after listing.
+func (s *KubeStore) ReadInstanceRecordsTeam(ctx context.Context, teamID string) ([]InstanceRecord, error) {
+	all, err := s.list(ctx, activeSelector)
+	if err != nil {
+		return nil, err
+	}
+	records := make([]InstanceRecord, 0)
+	for _, r := range all {
+		if r.TeamID == teamID {
+			records = append(records, r)
+		}
+	}
+	return records, nil
+}
+
+// PruneInstanceRecords deletes the ConfigMaps of instances destroyed before a time.
+func (s *KubeStore) PruneInstanceRecords(ctx context.Context, destroyedBefore time.Time) (int, error) {
+	// The id counter must exist before any record is deleted, or it would be created after a lower id
+	_, err := s.nextID(ctx)
+	if err != nil {
+		return 0, err
+	}
+	destroyed, err := s.list(ctx, fmt.Sprintf("%v,%v=%v", recordSelector, LabelRecordState, StateDestroyed))
+	if err != nil {
+		return 0, err
+	}
+	pruned := 0
+	for _, r := range destroyed {
+		if !r.DestroyedAt.Before(destroyedBefore) {
+			continue
+		}
+		err := s.client.Delete(ctx, recordName(r.Id), metav1.DeleteOptions{})
+		if err != nil && !apierrors.IsNotFound(err) {
+			return pruned, err
+		}
+		pruned++
+	}
+	return pruned, nil
+}
+
+// Close is a no-op, the store holds no connections.
+func (s *KubeStore) Close() error {
+	return nil
+}
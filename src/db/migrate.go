@@ -0,0 +1,134 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//go:embed migrations/*/*.sql
+var migrationFiles embed.FS
+
+// migration is a single versioned schema change.
+type migration struct {
+	version int
+	name    string
+	sql     string
+}
+
+// loadMigrations reads the embedded migrations of a dialect sorted by version.
+// Migration files are named migrations/<dialect>/NNNN_description.sql.
+func loadMigrations(files fs.FS, dialect string) ([]migration, error) {
+	dir := path.Join("migrations", dialect)
+	entries, err := fs.ReadDir(files, dir)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]migration, 0, len(entries))
+	for _, e := range entries {
+		name := e.Name()
+		prefix, _, ok := strings.Cut(name, "_")
+		if !ok || path.Ext(name) != ".sql" {
+			return nil, fmt.Errorf("invalid migration file name %q", name)
+		}
+		version, err := strconv.Atoi(prefix)
+		if err != nil {
+			return nil, fmt.Errorf("invalid migration version %q: %w", name, err)
+		}
+		content, err := fs.ReadFile(files, path.Join(dir, name))
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, migration{version: version, name: name, sql: string(content)})
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].version < res[j].version
+	})
+	for i := range res {
+		if res[i].version != i+1 {
+			return nil, fmt.Errorf("migration %q is out of sequence, expected version %v", res[i].name, i+1)
+		}
+	}
+	return res, nil
+}
+
+// schemaVersion returns the version of the latest migration applied to the database, 0 if none.
+func schemaVersion(ctx context.Context, q interface {
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}) (int, error) {
+	var version sql.NullInt64
+	err := q.QueryRowContext(ctx, "SELECT MAX(version) FROM schema_migrations").Scan(&version)
+	if err != nil {
+		return 0, err
+	}
+	return int(version.Int64), nil
+}
+
+// migrate applies every embedded migration newer than the schema version of the database, each in its own transaction.
+// It refuses to run against a database with a schema newer than the latest known migration.
+func (db *SQLStore) migrate(ctx context.Context) error {
+	migrations, err := loadMigrations(migrationFiles, db.dialect.name)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.ExecContext(ctx, "CREATE TABLE IF NOT EXISTS schema_migrations(version INTEGER PRIMARY KEY, name TEXT NOT NULL, applied_at BIGINT NOT NULL);")
+	if err != nil {
+		return err
+	}
+	current, err := schemaVersion(ctx, db.DB)
+	if err != nil {
+		return err
+	}
+	if current > len(migrations) {
+		return fmt.Errorf("database schema version %v is newer than the latest known version %v", current, len(migrations))
+	}
+
+	for _, m := range migrations[current:] {
+		err := db.applyMigration(ctx, m)
+		if err != nil {
+			return fmt.Errorf("migration %q failed: %w", m.name, err)
+		}
+	}
+	return nil
+}
+
+// applyMigration applies a single migration unless another process applied it first.
+func (db *SQLStore) applyMigration(ctx context.Context, m migration) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if db.dialect.lockMigrations != "" {
+		_, err = tx.ExecContext(ctx, db.dialect.lockMigrations)
+		if err != nil {
+			return err
+		}
+	}
+	current, err := schemaVersion(ctx, tx)
+	if err != nil {
+		return err
+	}
+	if current >= m.version {
+		return nil
+	}
+
+	_, err = tx.ExecContext(ctx, m.sql)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, db.rebind("INSERT INTO schema_migrations(version, name, applied_at) values(?, ?, ?)"), m.version, m.name, time.Now().Unix())
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
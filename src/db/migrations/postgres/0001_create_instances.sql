@@ -0,0 +1 @@
+CREATE TABLE IF NOT EXISTS instances(id BIGSERIAL PRIMARY KEY, challenge TEXT, team TEXT, expiry BIGINT, uuid TEXT);
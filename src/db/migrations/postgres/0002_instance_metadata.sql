@@ -0,0 +1,11 @@
+ALTER TABLE instances ADD COLUMN created_at BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE instances ADD COLUMN extensions INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE instances ADD COLUMN endpoints TEXT NOT NULL DEFAULT '[]';
+ALTER TABLE instances ADD COLUMN namespace TEXT NOT NULL DEFAULT 'challenges';
+ALTER TABLE instances ADD COLUMN isolated BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE instances ADD COLUMN kinds TEXT NOT NULL DEFAULT '[]';
+ALTER TABLE instances ADD COLUMN missing BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE instances ADD COLUMN state TEXT NOT NULL DEFAULT 'ready';
+ALTER TABLE instances ADD COLUMN error TEXT NOT NULL DEFAULT '';
+ALTER TABLE instances ADD COLUMN ready_at BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE instances ADD COLUMN destroyed_at BIGINT NOT NULL DEFAULT 0;
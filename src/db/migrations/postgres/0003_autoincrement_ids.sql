@@ -0,0 +1 @@
+-- BIGSERIAL ids are never reused, only SQLite needs its instances table rebuilt
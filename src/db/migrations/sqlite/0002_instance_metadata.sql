@@ -0,0 +1,12 @@
+ALTER TABLE instances ADD COLUMN created_at INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE instances ADD COLUMN extensions INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE instances ADD COLUMN endpoints TEXT NOT NULL DEFAULT '[]';
+ALTER TABLE instances ADD COLUMN namespace TEXT NOT NULL DEFAULT 'challenges';
+ALTER TABLE instances ADD COLUMN isolated INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE instances ADD COLUMN kinds TEXT NOT NULL DEFAULT '[]';
+ALTER TABLE instances ADD COLUMN missing INTEGER NOT NULL DEFAULT 0;
+-- Instances created before states were tracked are assumed to be ready
+ALTER TABLE instances ADD COLUMN state TEXT NOT NULL DEFAULT 'ready';
+ALTER TABLE instances ADD COLUMN error TEXT NOT NULL DEFAULT '';
+ALTER TABLE instances ADD COLUMN ready_at INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE instances ADD COLUMN destroyed_at INTEGER NOT NULL DEFAULT 0;
@@ -0,0 +1,17 @@
+-- Without AUTOINCREMENT SQLite reuses the id of the latest instance once its record is pruned
+CREATE TABLE instances_autoincrement(id INTEGER PRIMARY KEY AUTOINCREMENT, challenge TEXT, team TEXT, expiry INTEGER, uuid TEXT,
+	created_at INTEGER NOT NULL DEFAULT 0,
+	extensions INTEGER NOT NULL DEFAULT 0,
+	endpoints TEXT NOT NULL DEFAULT '[]',
+	namespace TEXT NOT NULL DEFAULT 'challenges',
+	isolated INTEGER NOT NULL DEFAULT 0,
+	kinds TEXT NOT NULL DEFAULT '[]',
+	missing INTEGER NOT NULL DEFAULT 0,
+	state TEXT NOT NULL DEFAULT 'ready',
+	error TEXT NOT NULL DEFAULT '',
+	ready_at INTEGER NOT NULL DEFAULT 0,
+	destroyed_at INTEGER NOT NULL DEFAULT 0);
+INSERT INTO instances_autoincrement(id, challenge, team, expiry, uuid, created_at, extensions, endpoints, namespace, isolated, kinds, missing, state, error, ready_at, destroyed_at)
+	SELECT id, challenge, team, expiry, uuid, created_at, extensions, endpoints, namespace, isolated, kinds, missing, state, error, ready_at, destroyed_at FROM instances;
+DROP TABLE instances;
+ALTER TABLE instances_autoincrement RENAME TO instances;
@@ -0,0 +1,39 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+
+	_ "github.com/jackc/pgx/v5/stdlib"
+)
+
+var postgresDialect = dialect{
+	name:           "postgres",
+	numberedParams: true,
+	// Replicas starting together must not apply the same migration twice
+	lockMigrations: "LOCK TABLE schema_migrations IN ACCESS EXCLUSIVE MODE",
+	// Conflicts with itself but not with reads, so quota checks of concurrent inserts are serialized
+	lockInstances: "LOCK TABLE instances IN SHARE ROW EXCLUSIVE MODE",
+}
+
+// NewPostgresStore connects to the PostgreSQL database at dsn and migrates it to the latest schema, within ctx.
+// The dsn is either a postgres:// url or a libpq keyword/value connection string.
+func NewPostgresStore(ctx context.Context, dsn string) (*SQLStore, error) {
+	sqlDB, err := sql.Open("pgx", dsn)
+	if err != nil {
+		return nil, err
+	}
+	err = sqlDB.PingContext(ctx)
+	if err != nil {
+		sqlDB.Close()
+		return nil, err
+	}
+
+	db := &SQLStore{DB: sqlDB, dialect: postgresDialect}
+	err = db.migrate(ctx)
+	if err != nil {
+		sqlDB.Close()
+		return nil, err
+	}
+	return db, nil
+}
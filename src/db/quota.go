@@ -0,0 +1,46 @@
+package db
+
+import "fmt"
+
+const (
+	// QuotaTeam limits the instances of a single team across all challenges.
+	QuotaTeam = "team"
+	// QuotaChallenge limits the instances of a single challenge across all teams.
+	QuotaChallenge = "challenge"
+	// QuotaCluster limits the instances across all teams and challenges.
+	QuotaCluster = "cluster"
+)
+
+// Quotas are the limits on active instances checked when inserting a record. Zero means unlimited.
+// Every instance which has neither failed nor been destroyed counts towards the quotas. Failed instances have no
+// objects left in the cluster, an instance whose objects could not be deleted stays terminating and keeps counting.
+type Quotas struct {
+	Team      int
+	Challenge int
+	Cluster   int
+}
+
+// QuotaExceededError is returned when inserting a record would exceed one of the quotas.
+type QuotaExceededError struct {
+	// Quota is one of QuotaTeam, QuotaChallenge or QuotaCluster
+	Quota string
+	Limit int
+}
+
+func (e *QuotaExceededError) Error() string {
+	return fmt.Sprintf("%v quota of %v active instances reached", e.Quota, e.Limit)
+}
+
+// check returns a QuotaExceededError if adding an instance to the counted active instances exceeds a quota.
+func (q Quotas) check(team int, challenge int, cluster int) error {
+	if q.Team > 0 && team >= q.Team {
+		return &QuotaExceededError{Quota: QuotaTeam, Limit: q.Team}
+	}
+	if q.Challenge > 0 && challenge >= q.Challenge {
+		return &QuotaExceededError{Quota: QuotaChallenge, Limit: q.Challenge}
+	}
+	if q.Cluster > 0 && cluster >= q.Cluster {
+		return &QuotaExceededError{Quota: QuotaCluster, Limit: q.Cluster}
+	}
+	return nil
+}
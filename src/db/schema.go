@@ -5,14 +5,60 @@ import (
 	"time"
 )
 
+// InstanceState is the lifecycle state of an instance
+type InstanceState string
+
+const (
+	StateProvisioning InstanceState = "provisioning"
+	StateReady        InstanceState = "ready"
+	StateFailed       InstanceState = "failed"
+	StateTerminating  InstanceState = "terminating"
+	StateDestroyed    InstanceState = "destroyed"
+)
+
 // InstanceRecord is a record used to keep track of an active instance
 type InstanceRecord struct {
-	Id        int64     `json:"id"`
-	Expiry    time.Time `json:"expiry"`
-	Challenge string    `json:"challenge"`
-	TeamID    string    `json:"team"`
-	UUID      string    `json:"uuid"`
-	Url       string    `json:"url"`
+	Id         int64      `json:"id"`
+	Expiry     time.Time  `json:"expiry"`
+	Created    time.Time  `json:"created_at"`
+	Extensions int        `json:"extensions"`
+	Challenge  string     `json:"challenge"`
+	TeamID     string     `json:"team"`
+	UUID       string     `json:"uuid"`
+	Url        string     `json:"url"`
+	Endpoints  []Endpoint `json:"endpoints"`
+	Namespace  string     `json:"namespace"`
+	// Isolated is set when the instance owns its namespace
+	Isolated bool `json:"isolated"`
+	// Kinds are the kinds of objects created for the instance
+	Kinds []ObjectKind `json:"kinds"`
+	// Missing is set when the objects of the instance are no longer found in the cluster
+	Missing bool          `json:"missing"`
+	State   InstanceState `json:"state"`
+	// Error is the reason the instance failed, if it did
+	Error       string    `json:"error,omitempty"`
+	ReadyAt     time.Time `json:"ready_at"`
+	DestroyedAt time.Time `json:"destroyed_at"`
+}
+
+// ObjectKind is the apiVersion and kind of a kubernetes object
+type ObjectKind struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+}
+
+// Endpoint is a rendered address exposed by an instance
+type Endpoint struct {
+	Name string `json:"name"`
+	URL  string `json:"url"`
+}
+
+// setUrl sets the primary url of the record to the first of its endpoints.
+func (r *InstanceRecord) setUrl() {
+	r.Url = ""
+	if len(r.Endpoints) > 0 {
+		r.Url = r.Endpoints[0].URL
+	}
 }
 
 func (r *InstanceRecord) MarshalJSON() ([]byte, error) {
@@ -0,0 +1,31 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+
+	_ "modernc.org/sqlite"
+)
+
+// SQLite needs no explicit locks, the single connection serializes every transaction
+var sqliteDialect = dialect{
+	name: "sqlite",
+}
+
+// NewSQLiteStore opens the SQLite database in file and migrates it to the latest schema, within ctx.
+func NewSQLiteStore(ctx context.Context, file string) (*SQLStore, error) {
+	sqlDB, err := sql.Open("sqlite", file)
+	if err != nil {
+		return nil, err
+	}
+	// SQLite should only have a single connection
+	sqlDB.SetMaxOpenConns(1)
+
+	db := &SQLStore{DB: sqlDB, dialect: sqliteDialect}
+	err = db.migrate(ctx)
+	if err != nil {
+		sqlDB.Close()
+		return nil, err
+	}
+	return db, nil
+}
@@ -0,0 +1,424 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ErrExtensionLimit is returned when an instance has reached its maximum number of extensions.
+var ErrExtensionLimit = errors.New("instance extension limit reached")
+
+// ErrNotFound is returned when a requested instance record does not exist.
+var ErrNotFound = errors.New("instance record not found")
+
+// ErrStateConflict is returned when an instance is not in the state expected by an update.
+var ErrStateConflict = errors.New("instance state changed concurrently")
+
+// DuplicateInstanceError is returned when inserting a record for a team which already has an active instance of the challenge.
+type DuplicateInstanceError struct {
+	Existing InstanceRecord
+}
+
+func (e *DuplicateInstanceError) Error() string {
+	return fmt.Sprintf("team %q already has instance %v of challenge %q", e.Existing.TeamID, e.Existing.Id, e.Existing.Challenge)
+}
+
+// InstanceStore stores the records of instances.
+type InstanceStore interface {
+	// InsertInstanceRecord stores a new instance described by rec which expires after ttl.
+	// The returned record has its id, creation time and expiry set.
+	// The quotas are checked atomically with the insert, a QuotaExceededError is returned if one is reached.
+	// A team may only have one active instance of each challenge, otherwise a DuplicateInstanceError holding it is returned.
+	// Failed instances are not active, they count neither as duplicates nor towards the quotas.
+	InsertInstanceRecord(ctx context.Context, ttl time.Duration, rec InstanceRecord, quotas Quotas) (InstanceRecord, error)
+	// ExtendInstanceRecord sets the expiry of an instance and increments its extension count.
+	// Only provisioning and ready instances can be extended, ErrStateConflict is returned for others.
+	ExtendInstanceRecord(ctx context.Context, id int64, expiry time.Time, maxExtensions int) (InstanceRecord, error)
+	// UpdateInstanceState moves an instance from state from to state to.
+	UpdateInstanceState(ctx context.Context, id int64, from InstanceState, to InstanceState, reason string) (InstanceRecord, error)
+	// RestartInstanceRecord moves an instance from state from back to provisioning to redeploy it,
+	// replacing its expiry and object kinds.
+	// Restarting a failed instance makes it active again, so it is checked atomically like an insert and may return
+	// a DuplicateInstanceError or a QuotaExceededError.
+	RestartInstanceRecord(ctx context.Context, id int64, from InstanceState, expiry time.Time, kinds []ObjectKind, quotas Quotas) (InstanceRecord, error)
+	// SetInstanceMissing marks whether the objects of an instance are missing from the cluster.
+	SetInstanceMissing(ctx context.Context, id int64, missing bool) error
+	// ReadInstanceRecord returns an instance in any state.
+	ReadInstanceRecord(ctx context.Context, id int64) (InstanceRecord, error)
+	// ReadInstanceRecords returns every instance which has not been destroyed, sorted by id.
+	ReadInstanceRecords(ctx context.Context) ([]InstanceRecord, error)
+	// ReadInstanceRecordsTeam returns every instance of a team which has not been destroyed, sorted by id.
+	// Failed instances are included, a team may have several of one challenge besides an active instance.
+	ReadInstanceRecordsTeam(ctx context.Context, teamID string) ([]InstanceRecord, error)
+	// PruneInstanceRecords deletes the records of instances destroyed before a time, returning the number deleted.
+	// Ids of pruned records are never reused.
+	PruneInstanceRecords(ctx context.Context, destroyedBefore time.Time) (int, error)
+	Close() error
+}
+
+// SQLStore is an InstanceStore backed by an SQL database.
+// Queries are written with '?' placeholders and rewritten for the dialect of the database.
+type SQLStore struct {
+	*sql.DB
+	dialect dialect
+}
+
+// dialect holds the differences between the supported SQL databases.
+type dialect struct {
+	// name is the directory of the migrations for the dialect
+	name string
+	// numberedParams is set for databases using $1, $2, ... placeholders
+	numberedParams bool
+	// lockMigrations is run before applying each migration to serialize concurrent migrations
+	lockMigrations string
+	// lockInstances is run in the transaction inserting a record to serialize quota checks
+	lockInstances string
+}
+
+// rebind rewrites the '?' placeholders of query for the dialect of the store.
+func (db *SQLStore) rebind(query string) string {
+	if !db.dialect.numberedParams {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	for _, c := range query {
+		if c == '?' {
+			n++
+			fmt.Fprintf(&b, "$%v", n)
+			continue
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+// scanInstanceRecord scans a row selected with instanceColumns into a record.
+func scanInstanceRecord(rows *sql.Rows) (InstanceRecord, error) {
+	record := InstanceRecord{}
+	var expiry, created, readyAt, destroyedAt int64
+	var endpoints, kinds string
+	err := rows.Scan(&record.Id, &record.Challenge, &record.TeamID, &expiry, &record.UUID, &created, &record.Extensions, &endpoints, &record.Namespace, &record.Isolated, &kinds, &record.Missing,
+		&record.State, &record.Error, &readyAt, &destroyedAt)
+	if err != nil {
+		return InstanceRecord{}, err
+	}
+	record.Expiry = time.Unix(expiry, 0)
+	record.Created = time.Unix(created, 0)
+	record.ReadyAt = unixOrZero(readyAt)
+	record.DestroyedAt = unixOrZero(destroyedAt)
+	err = json.Unmarshal([]byte(endpoints), &record.Endpoints)
+	if err != nil {
+		return InstanceRecord{}, fmt.Errorf("could not parse endpoints of record %v: %w", record.Id, err)
+	}
+	err = json.Unmarshal([]byte(kinds), &record.Kinds)
+	if err != nil {
+		return InstanceRecord{}, fmt.Errorf("could not parse kinds of record %v: %w", record.Id, err)
+	}
+	record.setUrl()
+	return record, nil
+}
+
+// unixOrZero converts a unix timestamp to a time, mapping 0 to the zero time.
+func unixOrZero(t int64) time.Time {
+	if t == 0 {
+		return time.Time{}
+	}
+	return time.Unix(t, 0)
+}
+
+const instanceColumns = "id, challenge, team, expiry, uuid, created_at, extensions, endpoints, namespace, isolated, kinds, missing, state, error, ready_at, destroyed_at"
+
+// InsertInstanceRecord stores a new instance described by rec which expires after ttl.
+// The returned record has its id, creation time and expiry set.
+// Active instances are counted in the same transaction as the insert, so concurrent inserts cannot exceed the quotas
+// or create two active instances of a challenge for the same team.
+func (db *SQLStore) InsertInstanceRecord(ctx context.Context, ttl time.Duration, rec InstanceRecord, quotas Quotas) (InstanceRecord, error) {
+	rec.State = StateProvisioning
+	rec.Created = time.Now()
+	rec.Expiry = rec.Created.Add(ttl)
+	if rec.Endpoints == nil {
+		rec.Endpoints = []Endpoint{}
+	}
+	if rec.Kinds == nil {
+		rec.Kinds = []ObjectKind{}
+	}
+	endpointsJSON, err := json.Marshal(rec.Endpoints)
+	if err != nil {
+		return InstanceRecord{}, err
+	}
+	kindsJSON, err := json.Marshal(rec.Kinds)
+	if err != nil {
+		return InstanceRecord{}, err
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return InstanceRecord{}, err
+	}
+	defer tx.Rollback()
+
+	err = db.checkActive(ctx, tx, rec.TeamID, rec.Challenge, quotas)
+	if err != nil {
+		return InstanceRecord{}, err
+	}
+
+	err = tx.QueryRowContext(ctx, db.rebind("INSERT INTO instances(challenge, team, expiry, uuid, created_at, endpoints, namespace, isolated, kinds, state) values(?, ?, ?, ?, ?, ?, ?, ?, ?, ?) RETURNING id"),
+		rec.Challenge, rec.TeamID, rec.Expiry.Unix(), rec.UUID, rec.Created.Unix(), string(endpointsJSON), rec.Namespace, rec.Isolated, string(kindsJSON), rec.State).Scan(&rec.Id)
+	if err != nil {
+		return InstanceRecord{}, err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return InstanceRecord{}, err
+	}
+
+	rec.setUrl()
+	return rec, nil
+}
+
+// checkActive returns a DuplicateInstanceError if a team already has an active instance of a challenge, or a
+// QuotaExceededError if another active instance would exceed a quota. Concurrent checks are serialized by locking
+// the instances, so the instance must be activated in the same transaction.
+func (db *SQLStore) checkActive(ctx context.Context, tx *sql.Tx, team string, challenge string, quotas Quotas) error {
+	if db.dialect.lockInstances != "" {
+		_, err := tx.ExecContext(ctx, db.dialect.lockInstances)
+		if err != nil {
+			return err
+		}
+	}
+	// Failed instances do not hold a slot, so a team can create the challenge again after a failed deploy
+	rows, err := tx.QueryContext(ctx, db.rebind("SELECT "+instanceColumns+" FROM instances WHERE team = ? AND challenge = ? AND state NOT IN (?, ?) ORDER BY id LIMIT 1"),
+		team, challenge, StateDestroyed, StateFailed)
+	if err != nil {
+		return err
+	}
+	if rows.Next() {
+		existing, err := scanInstanceRecord(rows)
+		rows.Close()
+		if err != nil {
+			return err
+		}
+		return &DuplicateInstanceError{existing}
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	var teamCount, challengeCount, clusterCount int
+	err = tx.QueryRowContext(ctx, db.rebind(`SELECT COALESCE(SUM(CASE WHEN team = ? THEN 1 ELSE 0 END), 0),
+		COALESCE(SUM(CASE WHEN challenge = ? THEN 1 ELSE 0 END), 0), COUNT(*)
+		FROM instances WHERE state NOT IN (?, ?)`), team, challenge, StateDestroyed, StateFailed).Scan(&teamCount, &challengeCount, &clusterCount)
+	if err != nil {
+		return err
+	}
+	return quotas.check(teamCount, challengeCount, clusterCount)
+}
+
+// ExtendInstanceRecord sets the expiry of an instance and increments its extension count.
+// The update only applies while the instance is provisioning or ready, otherwise ErrStateConflict is returned,
+// and while it has fewer than maxExtensions extensions, otherwise ErrExtensionLimit is returned.
+func (db *SQLStore) ExtendInstanceRecord(ctx context.Context, id int64, expiry time.Time, maxExtensions int) (InstanceRecord, error) {
+	stmt, err := db.PrepareContext(ctx, db.rebind("UPDATE instances SET expiry = ?, extensions = extensions + 1 WHERE id = ? AND extensions < ? AND state IN (?, ?)"))
+	if err != nil {
+		return InstanceRecord{}, err
+	}
+	defer stmt.Close()
+
+	res, err := stmt.ExecContext(ctx, expiry.Unix(), id, maxExtensions, StateProvisioning, StateReady)
+	if err != nil {
+		return InstanceRecord{}, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return InstanceRecord{}, err
+	}
+	if n == 0 {
+		rec, err := db.ReadInstanceRecord(ctx, id)
+		if err != nil {
+			return InstanceRecord{}, err
+		}
+		if rec.State != StateProvisioning && rec.State != StateReady {
+			return InstanceRecord{}, fmt.Errorf("instance %v is %v: %w", id, rec.State, ErrStateConflict)
+		}
+		return InstanceRecord{}, ErrExtensionLimit
+	}
+	return db.ReadInstanceRecord(ctx, id)
+}
+
+// UpdateInstanceState moves an instance from state from to state to, recording reason as its error.
+// The time an instance becomes ready or destroyed is recorded. ErrStateConflict is returned if the
+// instance is no longer in state from.
+func (db *SQLStore) UpdateInstanceState(ctx context.Context, id int64, from InstanceState, to InstanceState, reason string) (InstanceRecord, error) {
+	now := time.Now().Unix()
+	stmt, err := db.PrepareContext(ctx, db.rebind(`UPDATE instances SET state = ?, error = ?,
+		ready_at = CASE WHEN ? THEN ? ELSE ready_at END,
+		destroyed_at = CASE WHEN ? THEN ? ELSE destroyed_at END
+		WHERE id = ? AND state = ?`))
+	if err != nil {
+		return InstanceRecord{}, err
+	}
+	defer stmt.Close()
+
+	res, err := stmt.ExecContext(ctx, to, reason, to == StateReady, now, to == StateDestroyed, now, id, from)
+	if err != nil {
+		return InstanceRecord{}, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return InstanceRecord{}, err
+	}
+	if n == 0 {
+		return InstanceRecord{}, fmt.Errorf("instance %v is not %v: %w", id, from, ErrStateConflict)
+	}
+	return db.ReadInstanceRecord(ctx, id)
+}
+
+// RestartInstanceRecord moves an instance from state from back to provisioning to redeploy it,
+// replacing its expiry and object kinds and clearing its error. ErrStateConflict is returned if the
+// instance is no longer in state from. A failed instance becomes active again, so it is checked for
+// duplicates and against the quotas in the same transaction as the update, like an insert.
+func (db *SQLStore) RestartInstanceRecord(ctx context.Context, id int64, from InstanceState, expiry time.Time, kinds []ObjectKind, quotas Quotas) (InstanceRecord, error) {
+	if kinds == nil {
+		kinds = []ObjectKind{}
+	}
+	kindsJSON, err := json.Marshal(kinds)
+	if err != nil {
+		return InstanceRecord{}, err
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return InstanceRecord{}, err
+	}
+	defer tx.Rollback()
+
+	if from == StateFailed {
+		var team, challenge string
+		err = tx.QueryRowContext(ctx, db.rebind("SELECT team, challenge FROM instances WHERE id = ?"), id).Scan(&team, &challenge)
+		if errors.Is(err, sql.ErrNoRows) {
+			return InstanceRecord{}, fmt.Errorf("no record with id %v: %w", id, ErrNotFound)
+		}
+		if err != nil {
+			return InstanceRecord{}, err
+		}
+		err = db.checkActive(ctx, tx, team, challenge, quotas)
+		if err != nil {
+			return InstanceRecord{}, err
+		}
+	}
+
+	res, err := tx.ExecContext(ctx, db.rebind("UPDATE instances SET state = ?, error = '', missing = ?, expiry = ?, kinds = ? WHERE id = ? AND state = ?"),
+		StateProvisioning, false, expiry.Unix(), string(kindsJSON), id, from)
+	if err != nil {
+		return InstanceRecord{}, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return InstanceRecord{}, err
+	}
+	if n == 0 {
+		return InstanceRecord{}, fmt.Errorf("instance %v is not %v: %w", id, from, ErrStateConflict)
+	}
+	err = tx.Commit()
+	if err != nil {
+		return InstanceRecord{}, err
+	}
+	return db.ReadInstanceRecord(ctx, id)
+}
+
+// SetInstanceMissing marks whether the objects of an instance are missing from the cluster.
+func (db *SQLStore) SetInstanceMissing(ctx context.Context, id int64, missing bool) error {
+	stmt, err := db.PrepareContext(ctx, db.rebind("UPDATE instances SET missing = ? WHERE id = ?"))
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	_, err = stmt.ExecContext(ctx, missing, id)
+	return err
+}
+
+func (db *SQLStore) ReadInstanceRecord(ctx context.Context, id int64) (InstanceRecord, error) {
+	rows, err := db.QueryContext(ctx, db.rebind("SELECT "+instanceColumns+" FROM instances WHERE id = ?"), id)
+	if err != nil {
+		return InstanceRecord{}, err
+	}
+	defer rows.Close()
+	records := make([]InstanceRecord, 0)
+	for rows.Next() {
+		record, err := scanInstanceRecord(rows)
+		if err != nil {
+			return InstanceRecord{}, err
+		}
+		records = append(records, record)
+	}
+	if len(records) == 0 {
+		return InstanceRecord{}, fmt.Errorf("no record with id %v: %w", id, ErrNotFound)
+	}
+	if len(records) != 1 {
+		return InstanceRecord{}, fmt.Errorf("unique record not found with id %v", id)
+	}
+	err = rows.Err()
+	return records[0], err
+}
+
+// PruneInstanceRecords deletes the records of instances destroyed before a time.
+func (db *SQLStore) PruneInstanceRecords(ctx context.Context, destroyedBefore time.Time) (int, error) {
+	res, err := db.ExecContext(ctx, db.rebind("DELETE FROM instances WHERE state = ? AND destroyed_at < ?"), StateDestroyed, destroyedBefore.Unix())
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
+
+// ReadInstanceRecords returns every instance which has not been destroyed.
+func (db *SQLStore) ReadInstanceRecords(ctx context.Context) ([]InstanceRecord, error) {
+	rows, err := db.QueryContext(ctx, db.rebind("SELECT "+instanceColumns+" FROM instances WHERE state != ? ORDER BY id"), StateDestroyed)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	records := make([]InstanceRecord, 0)
+	for rows.Next() {
+		record, err := scanInstanceRecord(rows)
+		if err != nil {
+			return records, err
+		}
+		records = append(records, record)
+	}
+	err = rows.Err()
+	return records, err
+}
+
+// ReadInstanceRecordsTeam returns every instance of a team which has not been destroyed.
+func (db *SQLStore) ReadInstanceRecordsTeam(ctx context.Context, teamID string) ([]InstanceRecord, error) {
+	stmt, err := db.PrepareContext(ctx, db.rebind("SELECT "+instanceColumns+" FROM instances WHERE team = ? AND state != ? ORDER BY id"))
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+
+	rows, err := stmt.QueryContext(ctx, teamID, StateDestroyed)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	records := make([]InstanceRecord, 0)
+	for rows.Next() {
+		record, err := scanInstanceRecord(rows)
+		if err != nil {
+			return records, err
+		}
+		records = append(records, record)
+	}
+	err = rows.Err()
+	return records, err
+}
@@ -0,0 +1,225 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestSQLiteStore(t *testing.T) *SQLStore {
+	store, err := NewSQLiteStore(context.Background(), filepath.Join(t.TempDir(), "instances.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+func TestMigrateBaselineDatabase(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "instances.db")
+	sqlDB, err := sql.Open("sqlite", file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The schema and a record as written by releases before migrations were versioned
+	_, err = sqlDB.Exec("CREATE TABLE IF NOT EXISTS instances(id INTEGER PRIMARY KEY, challenge TEXT, team TEXT, expiry INTEGER, uuid TEXT);")
+	if err == nil {
+		_, err = sqlDB.Exec("INSERT INTO instances(challenge, team, expiry, uuid) values('chal', 'team', 0, 'abcd1234')")
+	}
+	sqlDB.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := NewSQLiteStore(context.Background(), file)
+	if err != nil {
+		t.Fatalf("migrating a baseline database returned %v", err)
+	}
+	defer store.Close()
+	records, err := store.ReadInstanceRecordsTeam(context.Background(), "team")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || records[0].State != StateReady {
+		t.Errorf("baseline record migrated to %+v, want a single ready record", records)
+	}
+}
+
+func TestInsertAfterFailedDeploy(t *testing.T) {
+	store := newTestSQLiteStore(t)
+	ctx := context.Background()
+	quotas := Quotas{Team: 1, Challenge: 1, Cluster: 1}
+	rec := InstanceRecord{Challenge: "chal", TeamID: "team", UUID: "abcd1234", Namespace: "challenges"}
+
+	failed, err := store.InsertInstanceRecord(ctx, time.Hour, rec, quotas)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = store.UpdateInstanceState(ctx, failed.Id, StateProvisioning, StateFailed, "deploy failed")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The failed instance is neither a duplicate nor counted against the quotas
+	created, err := store.InsertInstanceRecord(ctx, time.Hour, rec, quotas)
+	if err != nil {
+		t.Fatalf("create after a failed deploy returned %v", err)
+	}
+	if created.Id == failed.Id {
+		t.Errorf("create after a failed deploy reused id %v", failed.Id)
+	}
+
+	// The new instance is active again
+	_, err = store.InsertInstanceRecord(ctx, time.Hour, rec, quotas)
+	var dupErr *DuplicateInstanceError
+	if !errors.As(err, &dupErr) || dupErr.Existing.Id != created.Id {
+		t.Errorf("create with an active instance returned %v, want a duplicate of %v", err, created.Id)
+	}
+}
+
+func TestPruneDoesNotReuseIds(t *testing.T) {
+	store := newTestSQLiteStore(t)
+	ctx := context.Background()
+
+	var last InstanceRecord
+	for _, team := range []string{"a", "b"} {
+		rec, err := store.InsertInstanceRecord(ctx, time.Hour, InstanceRecord{Challenge: "chal", TeamID: team}, Quotas{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, to := range []InstanceState{StateTerminating, StateDestroyed} {
+			rec, err = store.UpdateInstanceState(ctx, rec.Id, rec.State, to, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		last = rec
+	}
+
+	n, err := store.PruneInstanceRecords(ctx, time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Errorf("pruned %v records, want 2", n)
+	}
+
+	rec, err := store.InsertInstanceRecord(ctx, time.Hour, InstanceRecord{Challenge: "chal", TeamID: "c"}, Quotas{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.Id <= last.Id {
+		t.Errorf("record inserted after pruning got id %v, want more than %v", rec.Id, last.Id)
+	}
+}
+
+func TestRestartFailedChecksActiveInstances(t *testing.T) {
+	store := newTestSQLiteStore(t)
+	ctx := context.Background()
+	rec := InstanceRecord{Challenge: "chal", TeamID: "team"}
+
+	var failed []InstanceRecord
+	for i := 0; i < 4; i++ {
+		f, err := store.InsertInstanceRecord(ctx, time.Hour, rec, Quotas{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		f, err = store.UpdateInstanceState(ctx, f.Id, StateProvisioning, StateFailed, "deploy failed")
+		if err != nil {
+			t.Fatal(err)
+		}
+		failed = append(failed, f)
+	}
+
+	// Concurrent restarts of failed instances of one challenge leave a single active instance
+	errs := make(chan error, len(failed))
+	for _, f := range failed {
+		go func(id int64) {
+			_, err := store.RestartInstanceRecord(ctx, id, StateFailed, time.Now().Add(time.Hour), nil, Quotas{})
+			errs <- err
+		}(f.Id)
+	}
+	restarted := 0
+	for range failed {
+		err := <-errs
+		var dupErr *DuplicateInstanceError
+		switch {
+		case err == nil:
+			restarted++
+		case !errors.As(err, &dupErr):
+			t.Errorf("concurrent restart returned %v, want a duplicate", err)
+		}
+	}
+	if restarted != 1 {
+		t.Errorf("%v concurrent restarts succeeded, want 1", restarted)
+	}
+
+	_, err := store.InsertInstanceRecord(ctx, time.Hour, rec, Quotas{})
+	var dupErr *DuplicateInstanceError
+	if !errors.As(err, &dupErr) {
+		t.Errorf("create after a restart returned %v, want a duplicate", err)
+	}
+
+	// A restarted failed instance counts towards the quotas again
+	other, err := store.InsertInstanceRecord(ctx, time.Hour, InstanceRecord{Challenge: "other", TeamID: "team"}, Quotas{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = store.UpdateInstanceState(ctx, other.Id, StateProvisioning, StateFailed, "deploy failed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = store.RestartInstanceRecord(ctx, other.Id, StateFailed, time.Now().Add(time.Hour), nil, Quotas{Team: 1})
+	var quotaErr *QuotaExceededError
+	if !errors.As(err, &quotaErr) || quotaErr.Quota != QuotaTeam {
+		t.Errorf("restart over the team quota returned %v, want a team quota error", err)
+	}
+}
+
+func TestExtendOnlyActiveInstances(t *testing.T) {
+	store := newTestSQLiteStore(t)
+	ctx := context.Background()
+	expiry := time.Now().Add(2 * time.Hour)
+
+	for _, to := range []InstanceState{StateFailed, StateTerminating} {
+		rec, err := store.InsertInstanceRecord(ctx, time.Hour, InstanceRecord{Challenge: "chal", TeamID: string(to)}, Quotas{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		rec, err = store.UpdateInstanceState(ctx, rec.Id, StateProvisioning, to, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = store.ExtendInstanceRecord(ctx, rec.Id, expiry, 3)
+		if !errors.Is(err, ErrStateConflict) {
+			t.Errorf("extending a %v instance returned %v, want a state conflict", to, err)
+		}
+		after, err := store.ReadInstanceRecord(ctx, rec.Id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !after.Expiry.Equal(rec.Expiry) || after.Extensions != 0 {
+			t.Errorf("extending a %v instance changed it to expire at %v after %v extensions", to, after.Expiry, after.Extensions)
+		}
+	}
+
+	rec, err := store.InsertInstanceRecord(ctx, time.Hour, InstanceRecord{Challenge: "chal", TeamID: "ready"}, Quotas{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = store.ExtendInstanceRecord(ctx, rec.Id, expiry, 1)
+	if err != nil {
+		t.Fatalf("extending a provisioning instance returned %v", err)
+	}
+	_, err = store.ExtendInstanceRecord(ctx, rec.Id, expiry, 1)
+	if !errors.Is(err, ErrExtensionLimit) {
+		t.Errorf("extending past the limit returned %v, want the extension limit", err)
+	}
+	_, err = store.ExtendInstanceRecord(ctx, rec.Id+100, expiry, 1)
+	if !errors.Is(err, ErrNotFound) {
+		t.Errorf("extending a missing instance returned %v, want not found", err)
+	}
+}
@@ -2,36 +2,70 @@ package instancer
 
 import (
 	"context"
-	"fmt"
+	"errors"
+	"net"
 	"net/http"
 	"strconv"
+	"time"
 
 	"github.com/labstack/echo-contrib/echoprometheus"
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
 	"github.com/rs/zerolog"
 	"github.com/ubcctf/instanced/src/adapters"
+	"github.com/ubcctf/instanced/src/db"
 )
 
 type InstancesResponse struct {
-	Action    string `json:"action"`
-	Challenge string `json:"challenge"`
-	ID        int64  `json:"id"`
-	URL       string `json:"url"`
+	Action    string           `json:"action"`
+	Challenge string           `json:"challenge"`
+	ID        int64            `json:"id"`
+	URL       string           `json:"url"`
+	Endpoints []db.Endpoint    `json:"endpoints"`
+	State     db.InstanceState `json:"state,omitempty"`
 }
 
-func initWebServer(log zerolog.Logger, logRequests bool) *echo.Echo {
+// QuotaExceededResponse is returned when an instance cannot be created because a quota was reached.
+type QuotaExceededResponse struct {
+	Error string `json:"error"`
+	Quota string `json:"quota"`
+	Limit int    `json:"limit"`
+}
+
+type InstanceStatusResponse struct {
+	ID        int64            `json:"id"`
+	Challenge string           `json:"challenge"`
+	Team      string           `json:"team"`
+	State     db.InstanceState `json:"state"`
+	Error     string           `json:"error,omitempty"`
+	Expiry    time.Time        `json:"expiry"`
+	URL       string           `json:"url"`
+	Endpoints []db.Endpoint    `json:"endpoints"`
+}
+
+type ExtendResponse struct {
+	Action     string    `json:"action"`
+	Challenge  string    `json:"challenge"`
+	ID         int64     `json:"id"`
+	Expiry     time.Time `json:"expiry"`
+	Extensions int       `json:"extensions"`
+}
+
+func initWebServer(log zerolog.Logger, logRequests bool, trustedProxies []*net.IPNet) *echo.Echo {
 	e := echo.New()
 	e.HideBanner = true
 	e.HidePort = true
+	e.IPExtractor = ipExtractor(trustedProxies)
 	e.Logger = adapters.NewEchoLog(log)
+	e.HTTPErrorHandler = v1ErrorHandler(e.DefaultHTTPErrorHandler)
 
 	// Register request logging middleware
 	if logRequests {
 		reqLog := log.With().Str("component", "echo-req").Logger()
 		e.Use(middleware.RequestLoggerWithConfig(middleware.RequestLoggerConfig{
-			LogURI:    true,
-			LogStatus: true,
+			LogURI:       true,
+			LogStatus:    true,
+			LogRequestID: true,
 			LogValuesFunc: func(c echo.Context, v middleware.RequestLoggerValues) error {
 				// Ignore healthcheck endpoint to prevent spam.
 				if c.Path() == "/healthz" {
@@ -40,26 +74,69 @@ func initWebServer(log zerolog.Logger, logRequests bool) *echo.Echo {
 				reqLog.Info().
 					Str("URI", v.URI).
 					Int("status", v.Status).
+					Str("request_id", v.RequestID).
 					Msg("request")
 				return nil
 			},
 		}))
 	}
 
+	// Every response carries a request id, which /api/v1 errors include for correlation with the logs
+	e.Use(middleware.RequestID())
 	e.Use(echoprometheus.NewMiddleware("instanced"))
 	e.GET("/metrics", echoprometheus.NewHandler())
 
 	return e
 }
 
+// ipExtractor returns how the client address of a request is found. Forwarding headers are set by the client,
+// so they are only read from the given proxies, and the address of the connection is used without any.
+func ipExtractor(trustedProxies []*net.IPNet) echo.IPExtractor {
+	if len(trustedProxies) == 0 {
+		return echo.ExtractIPDirect()
+	}
+	opts := []echo.TrustOption{echo.TrustLoopback(false), echo.TrustLinkLocal(false), echo.TrustPrivateNet(false)}
+	for _, p := range trustedProxies {
+		opts = append(opts, echo.TrustIPRange(p))
+	}
+	return echo.ExtractIPFromXFFHeader(opts...)
+}
+
+// requestTimeout is a middleware setting a deadline on the context of each request,
+// which bounds the kubernetes and database calls made by its handler.
+func requestTimeout(timeout time.Duration) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if timeout <= 0 {
+				return next(c)
+			}
+			ctx, cancel := context.WithTimeout(c.Request().Context(), timeout)
+			defer cancel()
+			c.SetRequest(c.Request().WithContext(ctx))
+			return next(c)
+		}
+	}
+}
+
 func (in *Instancer) registerRequestHandlers() {
 	// Register requst handlers
+	in.srv.Use(requestTimeout(in.conf.RequestTimeout))
+	in.srv.Use(in.authenticate())
+	admin := requireScope(ScopeAdmin)
+	ctfd := requireScope(ScopeCTFd)
 	in.srv.GET("/healthz", in.handleLivenessCheck)
-	in.srv.GET("/instances", in.handleInstanceList)
-	in.srv.POST("/instances", in.handleInstanceCreate)
-	in.srv.DELETE("/instances", in.handleInstanceDelete)
-	in.srv.GET("/challenges", in.handleInstanceListTeam)
-	in.srv.POST("/reload", in.handleCRDReload)
+	in.srv.GET("/openapi.json", in.handleOpenAPI)
+	in.registerV1Handlers()
+
+	// Deprecated aliases of the /api/v1 routes
+	in.srv.GET("/instances", in.handleInstanceList, admin, deprecated("/instances"))
+	in.srv.GET("/instances/:id", in.handleInstanceStatus, ctfd, deprecated("/instances/{id}"))
+	in.srv.POST("/instances", in.handleInstanceCreate, ctfd, deprecated("/teams/{team}/instances"))
+	in.srv.DELETE("/instances", in.handleInstanceDelete, ctfd, deprecated("/instances/{id}"))
+	in.srv.PATCH("/instances/:id/extend", in.handleInstanceExtend, ctfd, deprecated("/instances/{id}/extend"))
+	in.srv.POST("/instances/:id/restart", in.handleInstanceRestart, ctfd, deprecated("/instances/{id}/restart"))
+	in.srv.GET("/challenges", in.handleInstanceListTeam, ctfd, deprecated("/teams/{team}/challenges"))
+	in.srv.POST("/reload", in.handleCRDReload, admin, deprecated("/reload"))
 }
 
 func (in *Instancer) handleLivenessCheck(c echo.Context) error {
@@ -70,34 +147,66 @@ func (in *Instancer) handleInstanceCreate(c echo.Context) error {
 	chalName := c.QueryParam("chal")
 	teamID := c.QueryParam("team")
 
-	recs, err := in.dbC.ReadInstanceRecordsTeam(teamID)
-	if err != nil {
-		c.Logger().Errorf("request failed: %v", err)
-		return c.JSON(http.StatusInternalServerError, "challenge deploy failed: contact admin")
+	if limit, retry := in.checkRateLimits(c, teamID); limit != "" {
+		return rateLimited(c, limit, retry, "too many requests")
 	}
-	for _, r := range recs {
-		if r.Challenge == chalName {
-			return c.JSON(http.StatusTooManyRequests, "instance already exists for this challenge")
-		}
+	if retry := in.cooldowns.remaining(teamID, chalName, time.Now()); retry > 0 {
+		return rateLimited(c, LimitCooldown, retry, "challenge was destroyed recently, wait before recreating it")
 	}
 
-	rec, err := in.CreateInstance(chalName, teamID)
+	rec, err := in.CreateInstance(c.Request().Context(), chalName, teamID)
 	if _, ok := err.(*ChallengeNotFoundError); ok {
 		return c.JSON(http.StatusNotFound, "challenge not supported")
 	}
+	// Repeated requests get the instance created by the first
+	var dupErr *db.DuplicateInstanceError
+	if errors.As(err, &dupErr) {
+		existing := dupErr.Existing
+		return c.JSON(http.StatusOK, InstancesResponse{"exists", chalName, existing.Id, existing.Url, existing.Endpoints, existing.State})
+	}
+	var quotaErr *db.QuotaExceededError
+	if errors.As(err, &quotaErr) {
+		return c.JSON(http.StatusTooManyRequests, QuotaExceededResponse{quotaErr.Error(), quotaErr.Quota, quotaErr.Limit})
+	}
 
 	if err != nil {
-		// todo: handle errors/cleanup incomplete deploys?
 		c.Logger().Errorf("request failed: %v", err)
 		return c.JSON(http.StatusInternalServerError, "challenge deploy failed: contact admin")
 	}
 	c.Logger().Info("processed request to provision new instance")
-	return c.JSON(http.StatusAccepted, InstancesResponse{"created", chalName, rec.Id, fmt.Sprintf("https://%v.%v.ctf.maplebacon.org", rec.UUID, chalName)})
+	return c.JSON(http.StatusAccepted, InstancesResponse{"created", chalName, rec.Id, rec.Url, rec.Endpoints, rec.State})
+}
+
+func (in *Instancer) handleInstanceStatus(c echo.Context) error {
+	instanceID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, "invalid id")
+	}
+
+	rec, err := in.dbC.ReadInstanceRecord(c.Request().Context(), instanceID)
+	if errors.Is(err, db.ErrNotFound) {
+		return c.JSON(http.StatusNotFound, "instance id not found")
+	}
+	if err != nil {
+		c.Logger().Errorf("request failed: %v", err)
+		return c.JSON(http.StatusInternalServerError, "request failed")
+	}
+	return c.JSON(http.StatusOK, InstanceStatusResponse{
+		ID:        rec.Id,
+		Challenge: rec.Challenge,
+		Team:      rec.TeamID,
+		State:     rec.State,
+		Error:     rec.Error,
+		Expiry:    rec.Expiry,
+		URL:       rec.Url,
+		Endpoints: rec.Endpoints,
+	})
 }
 
 func (in *Instancer) handleInstanceDelete(c echo.Context) error {
+	// Purging is only done through the explicit /api/v1/purge endpoint
 	if !c.QueryParams().Has("id") {
-		return in.handleInstancePurge(c)
+		return c.JSON(http.StatusBadRequest, "missing id")
 	}
 	instanceID, err := strconv.ParseInt(c.QueryParam("id"), 10, 64)
 
@@ -105,14 +214,20 @@ func (in *Instancer) handleInstanceDelete(c echo.Context) error {
 		return c.JSON(http.StatusBadRequest, "invalid id")
 	}
 
-	rec, err := in.dbC.ReadInstanceRecord(instanceID)
+	rec, err := in.dbC.ReadInstanceRecord(c.Request().Context(), instanceID)
 
-	if err != nil {
-		c.Logger().Errorf("request failed: %v", err)
+	if err != nil || rec.State == db.StateDestroyed {
+		if err != nil {
+			c.Logger().Errorf("request failed: %v", err)
+		}
 		return c.JSON(http.StatusNotFound, "instance id not found")
 	}
 
-	err = in.DestroyInstance(rec)
+	if limit, retry := in.checkRateLimits(c, rec.TeamID); limit != "" {
+		return rateLimited(c, limit, retry, "too many requests")
+	}
+
+	err = in.QueueDestroyInstance(c.Request().Context(), rec.Id)
 
 	if _, ok := err.(*ChallengeNotFoundError); ok {
 		return c.JSON(http.StatusNotFound, "challenge not supported")
@@ -123,32 +238,79 @@ func (in *Instancer) handleInstanceDelete(c echo.Context) error {
 		c.Logger().Errorf("request failed: %v", err)
 		return c.JSON(http.StatusInternalServerError, "challenge destroy failed: contact admin")
 	}
+	in.cooldowns.start(rec.TeamID, rec.Challenge, time.Now())
 	c.Logger().Info("processed request to destroy an instance")
 
-	return c.JSON(http.StatusAccepted, InstancesResponse{"destroyed", rec.Challenge, instanceID, "TODO"})
+	return c.JSON(http.StatusAccepted, InstancesResponse{"destroyed", rec.Challenge, instanceID, rec.Url, rec.Endpoints, ""})
 }
 
-func (in *Instancer) handleInstancePurge(c echo.Context) error {
-	recs, err := in.dbC.ReadInstanceRecords()
+func (in *Instancer) handleInstanceExtend(c echo.Context) error {
+	instanceID, err := strconv.ParseInt(c.Param("id"), 10, 64)
 	if err != nil {
-		c.Logger().Errorf("request failed: %v", err)
+		return c.JSON(http.StatusBadRequest, "invalid id")
+	}
+
+	rec, err := in.ExtendInstance(c.Request().Context(), instanceID)
+	if _, ok := err.(*InstanceExtendError); ok {
+		return c.JSON(http.StatusConflict, err.Error())
+	}
+	if errors.Is(err, db.ErrNotFound) {
 		return c.JSON(http.StatusNotFound, "instance id not found")
 	}
-	go func() {
-		for _, r := range recs {
-			err = in.DestroyInstance(r)
-			if err != nil {
-				c.Logger().Error("an instance failed to purge")
-			}
+	if err != nil {
+		c.Logger().Errorf("request failed: %v", err)
+		return c.JSON(http.StatusInternalServerError, "challenge extend failed: contact admin")
+	}
+	c.Logger().Info("processed request to extend an instance")
+
+	return c.JSON(http.StatusOK, ExtendResponse{"extended", rec.Challenge, rec.Id, rec.Expiry, rec.Extensions})
+}
+
+func (in *Instancer) handleInstanceRestart(c echo.Context) error {
+	instanceID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, "invalid id")
+	}
+	resetExpiry := false
+	if c.QueryParams().Has("reset_expiry") {
+		resetExpiry, err = strconv.ParseBool(c.QueryParam("reset_expiry"))
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, "invalid reset_expiry")
 		}
-	}()
+	}
+
+	rec, err := in.dbC.ReadInstanceRecord(c.Request().Context(), instanceID)
+	if err != nil || rec.State == db.StateDestroyed {
+		if err != nil && !errors.Is(err, db.ErrNotFound) {
+			c.Logger().Errorf("request failed: %v", err)
+		}
+		return c.JSON(http.StatusNotFound, "instance id not found")
+	}
+	if limit, retry := in.checkRateLimits(c, rec.TeamID); limit != "" {
+		return rateLimited(c, limit, retry, "too many requests")
+	}
+
+	rec, err = in.RestartInstance(c.Request().Context(), instanceID, resetExpiry)
+	if _, ok := err.(*InstanceRestartError); ok {
+		return c.JSON(http.StatusConflict, err.Error())
+	}
+	if _, ok := err.(*ChallengeNotFoundError); ok {
+		return c.JSON(http.StatusNotFound, "challenge not supported")
+	}
+	if errors.Is(err, db.ErrNotFound) {
+		return c.JSON(http.StatusNotFound, "instance id not found")
+	}
+	if err != nil {
+		c.Logger().Errorf("request failed: %v", err)
+		return c.JSON(http.StatusInternalServerError, "challenge restart failed: contact admin")
+	}
+	c.Logger().Info("processed request to restart an instance")
 
-	return c.JSON(http.StatusAccepted, "instance purge started")
+	return c.JSON(http.StatusAccepted, InstancesResponse{"restarting", rec.Challenge, rec.Id, rec.Url, rec.Endpoints, rec.State})
 }
 
 func (in *Instancer) handleInstanceList(c echo.Context) error {
-	// todo: authenticate
-	records, err := in.dbC.ReadInstanceRecords()
+	records, err := in.dbC.ReadInstanceRecords(c.Request().Context())
 	if err != nil {
 		c.Logger().Errorf("request failed: %v", err)
 		return c.JSON(http.StatusInternalServerError, "request failed")
@@ -159,7 +321,7 @@ func (in *Instancer) handleInstanceList(c echo.Context) error {
 
 func (in *Instancer) handleInstanceListTeam(c echo.Context) error {
 	teamID := c.QueryParam("team")
-	records, err := in.GetTeamChallengeStates(teamID)
+	records, err := in.GetTeamChallengeStates(c.Request().Context(), teamID)
 	if err != nil {
 		c.Logger().Errorf("request failed: %v", err)
 		return c.JSON(http.StatusInternalServerError, "request failed")
@@ -169,6 +331,6 @@ func (in *Instancer) handleInstanceListTeam(c echo.Context) error {
 }
 
 func (in *Instancer) handleCRDReload(c echo.Context) error {
-	go in.LoadCRDs(context.TODO())
+	in.enqueueReload()
 	return c.JSON(http.StatusAccepted, "accepted")
 }
@@ -0,0 +1,240 @@
+package instancer
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/ubcctf/instanced/src/k8s"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/rest"
+)
+
+// fakeResource is a resource served by fakeAPIServer.
+type fakeResource struct {
+	groupVersion string
+	kind         string
+	namespaced   bool
+}
+
+var fakeResources = map[string]fakeResource{
+	"namespaces":      {"v1", "Namespace", false},
+	"configmaps":      {"v1", "ConfigMap", true},
+	"services":        {"v1", "Service", true},
+	"pods":            {"v1", "Pod", true},
+	"resourcequotas":  {"v1", "ResourceQuota", true},
+	"networkpolicies": {"networking.k8s.io/v1", "NetworkPolicy", true},
+	"deployments":     {"apps/v1", "Deployment", true},
+	"statefulsets":    {"apps/v1", "StatefulSet", true},
+}
+
+// fakeAPIServer is an in-memory apiserver supporting discovery and the create, list and delete requests of the instancer.
+// Like a real apiserver it refuses to create objects in a namespace which does not exist, and deleting a namespace
+// deletes every object in it.
+type fakeAPIServer struct {
+	mu sync.Mutex
+	// objs are the stored objects by resource, namespace and name
+	objs map[string]map[string]map[string]map[string]interface{}
+	// fail is the set of object names whose creation is rejected
+	fail map[string]bool
+}
+
+// newFakeAPIServer starts a fakeAPIServer for the duration of a test and returns a client of it.
+func newFakeAPIServer(t *testing.T) (*fakeAPIServer, k8s.KubeClient) {
+	f := &fakeAPIServer{objs: make(map[string]map[string]map[string]map[string]interface{}), fail: make(map[string]bool)}
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+	client, err := k8s.NewKubeClientForConfig(&rest.Config{Host: srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f, client
+}
+
+// setFail makes creating objects named name fail, or succeed again.
+func (f *fakeAPIServer) setFail(name string, fail bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.fail[name] = fail
+}
+
+// get returns the stored object of a resource, or nil.
+func (f *fakeAPIServer) get(resource, namespace, name string) map[string]interface{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.objs[resource][namespace][name]
+}
+
+// count returns the number of stored objects of a resource in a namespace.
+func (f *fakeAPIServer) count(resource, namespace string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.objs[resource][namespace])
+}
+
+func (f *fakeAPIServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	var groupVersion string
+	switch {
+	case len(parts) == 1 && parts[0] == "api":
+		writeJSON(w, http.StatusOK, &metav1.APIVersions{
+			TypeMeta: metav1.TypeMeta{Kind: "APIVersions"},
+			Versions: []string{"v1"},
+		})
+		return
+	case len(parts) == 1 && parts[0] == "apis":
+		writeJSON(w, http.StatusOK, fakeGroups())
+		return
+	case len(parts) >= 2 && parts[0] == "api":
+		groupVersion, parts = parts[1], parts[2:]
+	case len(parts) >= 3 && parts[0] == "apis":
+		groupVersion, parts = parts[1]+"/"+parts[2], parts[3:]
+	default:
+		writeStatus(w, apierrors.NewNotFound(schema.GroupResource{}, r.URL.Path))
+		return
+	}
+	if len(parts) == 0 {
+		writeJSON(w, http.StatusOK, fakeResourceList(groupVersion))
+		return
+	}
+
+	var namespace, resource, name string
+	switch {
+	case parts[0] == "namespaces" && len(parts) >= 3:
+		namespace, resource = parts[1], parts[2]
+		if len(parts) > 3 {
+			name = parts[3]
+		}
+	default:
+		resource = parts[0]
+		if len(parts) > 1 {
+			name = parts[1]
+		}
+	}
+	res, ok := fakeResources[resource]
+	if !ok || res.groupVersion != groupVersion {
+		writeStatus(w, apierrors.NewNotFound(schema.GroupResource{Resource: resource}, name))
+		return
+	}
+	gr := schema.GroupResource{Group: schema.FromAPIVersionAndKind(groupVersion, res.kind).Group, Resource: resource}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch {
+	case r.Method == http.MethodPost && name == "":
+		body, err := io.ReadAll(r.Body)
+		obj := make(map[string]interface{})
+		if err == nil {
+			err = json.Unmarshal(body, &obj)
+		}
+		if err != nil {
+			writeStatus(w, apierrors.NewBadRequest(err.Error()))
+			return
+		}
+		name = (&unstructured.Unstructured{Object: obj}).GetName()
+		if namespace != "" && f.objs["namespaces"][""][namespace] == nil {
+			writeStatus(w, apierrors.NewNotFound(schema.GroupResource{Resource: "namespaces"}, namespace))
+			return
+		}
+		if f.fail[name] {
+			writeStatus(w, apierrors.NewBadRequest("rejected by test"))
+			return
+		}
+		if f.objs[resource][namespace][name] != nil {
+			writeStatus(w, apierrors.NewAlreadyExists(gr, name))
+			return
+		}
+		if f.objs[resource] == nil {
+			f.objs[resource] = make(map[string]map[string]map[string]interface{})
+		}
+		if f.objs[resource][namespace] == nil {
+			f.objs[resource][namespace] = make(map[string]map[string]interface{})
+		}
+		f.objs[resource][namespace][name] = obj
+		writeJSON(w, http.StatusCreated, obj)
+	case r.Method == http.MethodGet && name == "":
+		selector, err := labels.Parse(r.URL.Query().Get("labelSelector"))
+		if err != nil {
+			writeStatus(w, apierrors.NewBadRequest(err.Error()))
+			return
+		}
+		items := make([]interface{}, 0)
+		for _, obj := range f.objs[resource][namespace] {
+			if selector.Matches(labels.Set((&unstructured.Unstructured{Object: obj}).GetLabels())) {
+				items = append(items, obj)
+			}
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"apiVersion": groupVersion,
+			"kind":       res.kind + "List",
+			"metadata":   map[string]interface{}{"resourceVersion": "1"},
+			"items":      items,
+		})
+	case r.Method == http.MethodGet:
+		obj := f.objs[resource][namespace][name]
+		if obj == nil {
+			writeStatus(w, apierrors.NewNotFound(gr, name))
+			return
+		}
+		writeJSON(w, http.StatusOK, obj)
+	case r.Method == http.MethodDelete && name != "":
+		if f.objs[resource][namespace][name] == nil {
+			writeStatus(w, apierrors.NewNotFound(gr, name))
+			return
+		}
+		delete(f.objs[resource][namespace], name)
+		if resource == "namespaces" {
+			for _, byNamespace := range f.objs {
+				delete(byNamespace, name)
+			}
+		}
+		writeJSON(w, http.StatusOK, &metav1.Status{TypeMeta: metav1.TypeMeta{Kind: "Status", APIVersion: "v1"}, Status: metav1.StatusSuccess})
+	default:
+		writeStatus(w, apierrors.NewMethodNotSupported(gr, r.Method))
+	}
+}
+
+func fakeGroups() *metav1.APIGroupList {
+	groups := &metav1.APIGroupList{TypeMeta: metav1.TypeMeta{Kind: "APIGroupList", APIVersion: "v1"}}
+	for _, gv := range []string{"apps/v1", "networking.k8s.io/v1"} {
+		group, version, _ := strings.Cut(gv, "/")
+		v := metav1.GroupVersionForDiscovery{GroupVersion: gv, Version: version}
+		groups.Groups = append(groups.Groups, metav1.APIGroup{Name: group, Versions: []metav1.GroupVersionForDiscovery{v}, PreferredVersion: v})
+	}
+	return groups
+}
+
+func fakeResourceList(groupVersion string) *metav1.APIResourceList {
+	list := &metav1.APIResourceList{TypeMeta: metav1.TypeMeta{Kind: "APIResourceList", APIVersion: "v1"}, GroupVersion: groupVersion}
+	for name, res := range fakeResources {
+		if res.groupVersion == groupVersion {
+			list.APIResources = append(list.APIResources, metav1.APIResource{
+				Name:       name,
+				Namespaced: res.namespaced,
+				Kind:       res.kind,
+				Verbs:      metav1.Verbs{"create", "delete", "get", "list"},
+			})
+		}
+	}
+	return list
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeStatus(w http.ResponseWriter, err *apierrors.StatusError) {
+	status := err.Status()
+	status.TypeMeta = metav1.TypeMeta{Kind: "Status", APIVersion: "v1"}
+	writeJSON(w, int(status.Code), &status)
+}
@@ -0,0 +1,379 @@
+package instancer
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/ubcctf/instanced/src/db"
+)
+
+const apiV1Prefix = "/api/v1"
+
+// Machine-readable error codes returned in APIError.
+const (
+	CodeInvalidRequest    = "invalid_request"
+	CodeUnauthorized      = "unauthorized"
+	CodeForbidden         = "forbidden"
+	CodeNotFound          = "not_found"
+	CodeChallengeNotFound = "challenge_not_found"
+	CodeConflict          = "conflict"
+	CodeQuotaExceeded     = "quota_exceeded"
+	CodeRateLimited       = "rate_limited"
+	CodeTimeout           = "timeout"
+	CodeInternal          = "internal_error"
+)
+
+// APIError is the error object returned by every /api/v1 endpoint.
+type APIError struct {
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	RequestID string `json:"request_id"`
+	// Details holds additional fields for some codes, such as the quota which was reached
+	Details map[string]interface{} `json:"details,omitempty"`
+}
+
+// APIErrorResponse wraps an APIError.
+type APIErrorResponse struct {
+	Error APIError `json:"error"`
+}
+
+// InstanceResponse is the representation of an instance in the /api/v1 endpoints.
+type InstanceResponse struct {
+	ID         int64            `json:"id"`
+	Challenge  string           `json:"challenge"`
+	Team       string           `json:"team"`
+	State      db.InstanceState `json:"state"`
+	Error      string           `json:"error,omitempty"`
+	CreatedAt  time.Time        `json:"created_at"`
+	Expiry     time.Time        `json:"expiry"`
+	Extensions int              `json:"extensions"`
+	URL        string           `json:"url"`
+	Endpoints  []db.Endpoint    `json:"endpoints"`
+}
+
+// ChallengeResponse is the representation of a loaded challenge in the /api/v1 endpoints.
+type ChallengeResponse struct {
+	Name     string    `json:"name"`
+	Version  uint64    `json:"version"`
+	LoadedAt time.Time `json:"loaded_at"`
+}
+
+// TeamChallengeResponse is the state of a challenge for a team, with its active instance if there is one.
+type TeamChallengeResponse struct {
+	Challenge string            `json:"challenge"`
+	Instance  *InstanceResponse `json:"instance"`
+}
+
+// CreateInstanceRequest is the body of a request to create an instance for a team.
+type CreateInstanceRequest struct {
+	Challenge string `json:"challenge"`
+}
+
+func newInstanceResponse(rec db.InstanceRecord) InstanceResponse {
+	endpoints := rec.Endpoints
+	if endpoints == nil {
+		endpoints = []db.Endpoint{}
+	}
+	return InstanceResponse{
+		ID:         rec.Id,
+		Challenge:  rec.Challenge,
+		Team:       rec.TeamID,
+		State:      rec.State,
+		Error:      rec.Error,
+		CreatedAt:  rec.Created,
+		Expiry:     rec.Expiry,
+		Extensions: rec.Extensions,
+		URL:        rec.Url,
+		Endpoints:  endpoints,
+	}
+}
+
+// isAPIV1 reports whether a request was routed to an /api/v1 endpoint.
+func isAPIV1(c echo.Context) bool {
+	return strings.HasPrefix(c.Path(), apiV1Prefix+"/")
+}
+
+// apiError responds with an APIError carrying the id of the request.
+func apiError(c echo.Context, status int, code string, message string, details map[string]interface{}) error {
+	return c.JSON(status, APIErrorResponse{APIError{
+		Code:      code,
+		Message:   message,
+		RequestID: c.Response().Header().Get(echo.HeaderXRequestID),
+		Details:   details,
+	}})
+}
+
+// internalError logs the cause of a failed request and responds without exposing it.
+// Requests which ran past their deadline are reported as timeouts.
+func internalError(c echo.Context, err error) error {
+	if errors.Is(err, context.DeadlineExceeded) {
+		c.Logger().Warnf("request timed out: %v", err)
+		return apiError(c, http.StatusGatewayTimeout, CodeTimeout, "request timed out", nil)
+	}
+	c.Logger().Errorf("request failed: %v", err)
+	return apiError(c, http.StatusInternalServerError, CodeInternal, "request failed: contact admin", nil)
+}
+
+// v1ErrorHandler wraps an echo error handler so errors raised by echo itself, such as unknown routes,
+// use the error envelope for /api/v1 requests.
+func v1ErrorHandler(next echo.HTTPErrorHandler) echo.HTTPErrorHandler {
+	return func(err error, c echo.Context) {
+		var he *echo.HTTPError
+		if c.Response().Committed || !strings.HasPrefix(c.Request().URL.Path, apiV1Prefix+"/") || !errors.As(err, &he) {
+			next(err, c)
+			return
+		}
+		code := CodeInternal
+		switch he.Code {
+		case http.StatusNotFound:
+			code = CodeNotFound
+		case http.StatusUnauthorized:
+			code = CodeUnauthorized
+		case http.StatusForbidden:
+			code = CodeForbidden
+		case http.StatusTooManyRequests:
+			code = CodeRateLimited
+		default:
+			if he.Code < http.StatusInternalServerError {
+				code = CodeInvalidRequest
+			}
+		}
+		err = apiError(c, he.Code, code, http.StatusText(he.Code), nil)
+		if err != nil {
+			c.Logger().Error(err)
+		}
+	}
+}
+
+// deprecated is a route middleware marking a legacy route as superseded by an /api/v1 route.
+func deprecated(successor string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			c.Response().Header().Set("Deprecation", "true")
+			c.Response().Header().Set("Link", "<"+apiV1Prefix+successor+`>; rel="successor-version"`)
+			return next(c)
+		}
+	}
+}
+
+func (in *Instancer) registerV1Handlers() {
+	admin := requireScope(ScopeAdmin)
+	ctfd := requireScope(ScopeCTFd)
+	v1 := in.srv.Group(apiV1Prefix)
+	v1.GET("/instances", in.handleV1InstanceList, admin)
+	v1.GET("/instances/:id", in.handleV1InstanceGet, ctfd)
+	v1.DELETE("/instances/:id", in.handleV1InstanceDelete, ctfd)
+	v1.POST("/instances/:id/extend", in.handleV1InstanceExtend, ctfd)
+	v1.POST("/instances/:id/restart", in.handleV1InstanceRestart, ctfd)
+	v1.GET("/teams/:team/instances", in.handleV1TeamInstanceList, ctfd)
+	v1.POST("/teams/:team/instances", in.handleV1TeamInstanceCreate, ctfd)
+	v1.GET("/teams/:team/challenges", in.handleV1TeamChallengeList, ctfd)
+	v1.GET("/challenges", in.handleV1ChallengeList, ctfd)
+	v1.POST("/reload", in.handleV1Reload, admin)
+	v1.GET("/purge", in.handleV1PurgeList, admin)
+	v1.POST("/purge", in.handleV1Purge, admin)
+	v1.GET("/purge/:id", in.handleV1PurgeGet, admin)
+}
+
+// v1InstanceParam reads the active instance named by the id path parameter.
+// If it cannot be read the error response has already been written and handled is set.
+func (in *Instancer) v1InstanceParam(c echo.Context) (rec db.InstanceRecord, handled bool, err error) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return rec, true, apiError(c, http.StatusBadRequest, CodeInvalidRequest, "invalid instance id", nil)
+	}
+	rec, err = in.dbC.ReadInstanceRecord(c.Request().Context(), id)
+	if errors.Is(err, db.ErrNotFound) || (err == nil && rec.State == db.StateDestroyed) {
+		return rec, true, apiError(c, http.StatusNotFound, CodeNotFound, "instance not found", nil)
+	}
+	if err != nil {
+		return rec, true, internalError(c, err)
+	}
+	return rec, false, nil
+}
+
+// v1RateLimited responds to a request rejected by limit, setting the Retry-After header.
+func v1RateLimited(c echo.Context, limit string, retry time.Duration, message string) error {
+	seconds := setRetryAfter(c, limit, retry)
+	return apiError(c, http.StatusTooManyRequests, CodeRateLimited, message, map[string]interface{}{
+		"limit":       limit,
+		"retry_after": seconds,
+	})
+}
+
+func (in *Instancer) handleV1InstanceList(c echo.Context) error {
+	records, err := in.dbC.ReadInstanceRecords(c.Request().Context())
+	if err != nil {
+		return internalError(c, err)
+	}
+	res := make([]InstanceResponse, 0, len(records))
+	for _, r := range records {
+		res = append(res, newInstanceResponse(r))
+	}
+	return c.JSON(http.StatusOK, res)
+}
+
+func (in *Instancer) handleV1InstanceGet(c echo.Context) error {
+	rec, handled, err := in.v1InstanceParam(c)
+	if handled {
+		return err
+	}
+	return c.JSON(http.StatusOK, newInstanceResponse(rec))
+}
+
+func (in *Instancer) handleV1InstanceDelete(c echo.Context) error {
+	rec, handled, err := in.v1InstanceParam(c)
+	if handled {
+		return err
+	}
+	if limit, retry := in.checkRateLimits(c, rec.TeamID); limit != "" {
+		return v1RateLimited(c, limit, retry, "too many requests")
+	}
+
+	err = in.QueueDestroyInstance(c.Request().Context(), rec.Id)
+	if errors.Is(err, db.ErrStateConflict) {
+		return apiError(c, http.StatusConflict, CodeConflict, "instance changed state concurrently", nil)
+	}
+	if err != nil {
+		return internalError(c, err)
+	}
+	in.cooldowns.start(rec.TeamID, rec.Challenge, time.Now())
+	c.Logger().Info("processed request to destroy an instance")
+
+	rec, err = in.dbC.ReadInstanceRecord(c.Request().Context(), rec.Id)
+	if err != nil {
+		return internalError(c, err)
+	}
+	return c.JSON(http.StatusOK, newInstanceResponse(rec))
+}
+
+func (in *Instancer) handleV1InstanceExtend(c echo.Context) error {
+	rec, handled, err := in.v1InstanceParam(c)
+	if handled {
+		return err
+	}
+	rec, err = in.ExtendInstance(c.Request().Context(), rec.Id)
+	if _, ok := err.(*InstanceExtendError); ok {
+		return apiError(c, http.StatusConflict, CodeConflict, err.Error(), nil)
+	}
+	if err != nil {
+		return internalError(c, err)
+	}
+	c.Logger().Info("processed request to extend an instance")
+	return c.JSON(http.StatusOK, newInstanceResponse(rec))
+}
+
+func (in *Instancer) handleV1InstanceRestart(c echo.Context) error {
+	rec, handled, err := in.v1InstanceParam(c)
+	if handled {
+		return err
+	}
+	resetExpiry := false
+	if c.QueryParams().Has("reset_expiry") {
+		resetExpiry, err = strconv.ParseBool(c.QueryParam("reset_expiry"))
+		if err != nil {
+			return apiError(c, http.StatusBadRequest, CodeInvalidRequest, "invalid reset_expiry", nil)
+		}
+	}
+	if limit, retry := in.checkRateLimits(c, rec.TeamID); limit != "" {
+		return v1RateLimited(c, limit, retry, "too many requests")
+	}
+
+	rec, err = in.RestartInstance(c.Request().Context(), rec.Id, resetExpiry)
+	if _, ok := err.(*InstanceRestartError); ok {
+		return apiError(c, http.StatusConflict, CodeConflict, err.Error(), nil)
+	}
+	if _, ok := err.(*ChallengeNotFoundError); ok {
+		return apiError(c, http.StatusNotFound, CodeChallengeNotFound, "challenge not supported", nil)
+	}
+	if err != nil {
+		return internalError(c, err)
+	}
+	c.Logger().Info("processed request to restart an instance")
+	return c.JSON(http.StatusAccepted, newInstanceResponse(rec))
+}
+
+func (in *Instancer) handleV1TeamInstanceList(c echo.Context) error {
+	records, err := in.dbC.ReadInstanceRecordsTeam(c.Request().Context(), c.Param("team"))
+	if err != nil {
+		return internalError(c, err)
+	}
+	res := make([]InstanceResponse, 0, len(records))
+	for _, r := range records {
+		res = append(res, newInstanceResponse(r))
+	}
+	return c.JSON(http.StatusOK, res)
+}
+
+func (in *Instancer) handleV1TeamInstanceCreate(c echo.Context) error {
+	teamID := c.Param("team")
+	var req CreateInstanceRequest
+	if err := c.Bind(&req); err != nil || req.Challenge == "" {
+		return apiError(c, http.StatusBadRequest, CodeInvalidRequest, "request body must name a challenge", nil)
+	}
+
+	if limit, retry := in.checkRateLimits(c, teamID); limit != "" {
+		return v1RateLimited(c, limit, retry, "too many requests")
+	}
+	if retry := in.cooldowns.remaining(teamID, req.Challenge, time.Now()); retry > 0 {
+		return v1RateLimited(c, LimitCooldown, retry, "challenge was destroyed recently, wait before recreating it")
+	}
+
+	rec, err := in.CreateInstance(c.Request().Context(), req.Challenge, teamID)
+	if _, ok := err.(*ChallengeNotFoundError); ok {
+		return apiError(c, http.StatusNotFound, CodeChallengeNotFound, "challenge not supported", nil)
+	}
+	// Repeated requests get the instance created by the first
+	var dupErr *db.DuplicateInstanceError
+	if errors.As(err, &dupErr) {
+		return c.JSON(http.StatusOK, newInstanceResponse(dupErr.Existing))
+	}
+	var quotaErr *db.QuotaExceededError
+	if errors.As(err, &quotaErr) {
+		return apiError(c, http.StatusTooManyRequests, CodeQuotaExceeded, quotaErr.Error(), map[string]interface{}{
+			"quota": quotaErr.Quota,
+			"limit": quotaErr.Limit,
+		})
+	}
+	if err != nil {
+		return internalError(c, err)
+	}
+	c.Logger().Info("processed request to provision new instance")
+	return c.JSON(http.StatusAccepted, newInstanceResponse(rec))
+}
+
+func (in *Instancer) handleV1TeamChallengeList(c echo.Context) error {
+	records, err := in.dbC.ReadInstanceRecordsTeam(c.Request().Context(), c.Param("team"))
+	if err != nil {
+		return internalError(c, err)
+	}
+	res := make([]TeamChallengeResponse, 0)
+	for _, chal := range in.challenges.List() {
+		state := TeamChallengeResponse{Challenge: chal.Name}
+		if r, ok := teamChallengeInstance(records, chal.Name); ok {
+			inst := newInstanceResponse(r)
+			state.Instance = &inst
+		}
+		res = append(res, state)
+	}
+	return c.JSON(http.StatusOK, res)
+}
+
+func (in *Instancer) handleV1ChallengeList(c echo.Context) error {
+	chals := in.challenges.List()
+	res := make([]ChallengeResponse, 0, len(chals))
+	for _, chal := range chals {
+		res = append(res, ChallengeResponse{chal.Name, chal.Version, chal.LoadedAt})
+	}
+	return c.JSON(http.StatusOK, res)
+}
+
+func (in *Instancer) handleV1Reload(c echo.Context) error {
+	in.enqueueReload()
+	return c.NoContent(http.StatusAccepted)
+}
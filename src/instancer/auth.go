@@ -0,0 +1,99 @@
+package instancer
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	// ScopeAdmin grants access to every endpoint, including destructive ones.
+	ScopeAdmin = "admin"
+	// ScopeCTFd grants access to the endpoints used by the CTFd integration.
+	ScopeCTFd = "ctfd"
+)
+
+const tokenContextKey = "instanced-token"
+
+// APIToken is a named bearer token accepted by the API server.
+type APIToken struct {
+	Name  string `mapstructure:"name"`
+	Token string `mapstructure:"token"`
+	Scope string `mapstructure:"scope"`
+}
+
+// ErrorResponse is the body returned for rejected requests.
+type ErrorResponse struct {
+	Error string `json:"error"`
+}
+
+// allows reports whether a token with this scope may access an endpoint requiring scope.
+func (t *APIToken) allows(scope string) bool {
+	return t.Scope == ScopeAdmin || t.Scope == scope
+}
+
+// authSkipper excludes the healthcheck, metrics and API specification endpoints from authentication.
+func authSkipper(c echo.Context) bool {
+	return c.Path() == "/healthz" || c.Path() == "/metrics" || c.Path() == "/openapi.json"
+}
+
+// authenticate is a middleware which requires a valid bearer token on every request.
+// The matched token is stored in the request context for use by requireScope.
+func (in *Instancer) authenticate() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if authSkipper(c) {
+				return next(c)
+			}
+			auth := c.Request().Header.Get(echo.HeaderAuthorization)
+			provided, ok := strings.CutPrefix(auth, "Bearer ")
+			if !ok || provided == "" {
+				c.Response().Header().Set(echo.HeaderWWWAuthenticate, "Bearer")
+				return authError(c, http.StatusUnauthorized, CodeUnauthorized, "missing bearer token")
+			}
+			tok := in.lookupToken(provided)
+			if tok == nil {
+				c.Response().Header().Set(echo.HeaderWWWAuthenticate, "Bearer")
+				return authError(c, http.StatusUnauthorized, CodeUnauthorized, "invalid bearer token")
+			}
+			c.Set(tokenContextKey, tok)
+			return next(c)
+		}
+	}
+}
+
+// requireScope is a route middleware which rejects requests made with a token lacking scope.
+func requireScope(scope string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			tok, ok := c.Get(tokenContextKey).(*APIToken)
+			if !ok || !tok.allows(scope) {
+				return authError(c, http.StatusForbidden, CodeForbidden, "token not permitted to access this endpoint")
+			}
+			return next(c)
+		}
+	}
+}
+
+// authError rejects a request, using the error envelope of the API version it was routed to.
+func authError(c echo.Context, status int, code string, message string) error {
+	if isAPIV1(c) {
+		return apiError(c, status, code, message, nil)
+	}
+	return c.JSON(status, ErrorResponse{message})
+}
+
+// lookupToken returns the configured token matching provided, or nil if none match.
+// Every token is compared in constant time so the response time does not leak which tokens exist.
+func (in *Instancer) lookupToken(provided string) *APIToken {
+	var match *APIToken
+	for i := range in.conf.APITokens {
+		t := &in.conf.APITokens[i]
+		if subtle.ConstantTimeCompare([]byte(provided), []byte(t.Token)) == 1 && match == nil {
+			match = t
+		}
+	}
+	return match
+}
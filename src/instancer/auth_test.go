@@ -0,0 +1,116 @@
+package instancer
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/rs/zerolog"
+)
+
+// withTokens configures the tokens accepted by the shared test server for the duration of a test.
+func withTokens(t *testing.T, tokens []APIToken) *Instancer {
+	in := testServer()
+	prev := in.conf.APITokens
+	in.conf.APITokens = tokens
+	t.Cleanup(func() { in.conf.APITokens = prev })
+	return in
+}
+
+type authCase struct {
+	name   string
+	method string
+	path   string
+	// auth is the Authorization header, which is not sent if empty
+	auth   string
+	status int
+	// code is the error code expected in the /api/v1 envelope, or empty for successes and legacy routes
+	code string
+}
+
+func runAuthCases(t *testing.T, in *Instancer, cases []authCase) {
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(tc.method, tc.path, nil)
+			if tc.auth != "" {
+				req.Header.Set("Authorization", tc.auth)
+			}
+			resp := httptest.NewRecorder()
+			in.srv.ServeHTTP(resp, req)
+
+			if resp.Code != tc.status {
+				t.Fatalf("%v %v returned %v, want %v: %v", tc.method, tc.path, resp.Code, tc.status, resp.Body)
+			}
+			if tc.status == http.StatusUnauthorized && resp.Header().Get("WWW-Authenticate") != "Bearer" {
+				t.Errorf("401 response is missing the WWW-Authenticate challenge")
+			}
+			if tc.status < 400 {
+				return
+			}
+			if tc.code == "" {
+				// Legacy routes keep their plain error body
+				var body ErrorResponse
+				if err := json.Unmarshal(resp.Body.Bytes(), &body); err != nil || body.Error == "" {
+					t.Errorf("response %v is not a legacy error body", resp.Body)
+				}
+				return
+			}
+			var body APIErrorResponse
+			if err := json.Unmarshal(resp.Body.Bytes(), &body); err != nil {
+				t.Fatalf("response is not an error envelope: %v: %v", err, resp.Body)
+			}
+			if body.Error.Code != tc.code || body.Error.Message == "" || body.Error.RequestID == "" {
+				t.Errorf("error envelope %+v, want code %q with a message and request id", body.Error, tc.code)
+			}
+		})
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	in := withTokens(t, []APIToken{
+		{Name: "admin", Token: "admin-secret", Scope: ScopeAdmin},
+		{Name: "ctfd", Token: "ctfd-secret", Scope: ScopeCTFd},
+	})
+	runAuthCases(t, in, []authCase{
+		{"missing header", http.MethodGet, "/api/v1/challenges", "", http.StatusUnauthorized, CodeUnauthorized},
+		{"basic auth", http.MethodGet, "/api/v1/challenges", "Basic Y3RmZDpjdGZkLXNlY3JldA==", http.StatusUnauthorized, CodeUnauthorized},
+		{"lowercase scheme", http.MethodGet, "/api/v1/challenges", "bearer ctfd-secret", http.StatusUnauthorized, CodeUnauthorized},
+		{"token without scheme", http.MethodGet, "/api/v1/challenges", "ctfd-secret", http.StatusUnauthorized, CodeUnauthorized},
+		{"empty bearer", http.MethodGet, "/api/v1/challenges", "Bearer ", http.StatusUnauthorized, CodeUnauthorized},
+		{"wrong token", http.MethodGet, "/api/v1/challenges", "Bearer not-a-token", http.StatusUnauthorized, CodeUnauthorized},
+		{"token prefix", http.MethodGet, "/api/v1/challenges", "Bearer ctfd-secre", http.StatusUnauthorized, CodeUnauthorized},
+		{"ctfd token", http.MethodGet, "/api/v1/challenges", "Bearer ctfd-secret", http.StatusOK, ""},
+		{"admin token on ctfd route", http.MethodGet, "/api/v1/challenges", "Bearer admin-secret", http.StatusOK, ""},
+		{"ctfd token on admin route", http.MethodGet, "/api/v1/purge", "Bearer ctfd-secret", http.StatusForbidden, CodeForbidden},
+		{"ctfd token on admin route without body", http.MethodPost, "/api/v1/reload", "Bearer ctfd-secret", http.StatusForbidden, CodeForbidden},
+		{"ctfd token on legacy admin route", http.MethodGet, "/instances", "Bearer ctfd-secret", http.StatusForbidden, ""},
+		{"wrong token on legacy route", http.MethodGet, "/instances", "Bearer not-a-token", http.StatusUnauthorized, ""},
+		{"healthz", http.MethodGet, "/healthz", "", http.StatusOK, ""},
+		{"metrics", http.MethodGet, "/metrics", "", http.StatusOK, ""},
+		{"openapi", http.MethodGet, "/openapi.json", "", http.StatusOK, ""},
+		{"healthz with wrong token", http.MethodGet, "/healthz", "Bearer not-a-token", http.StatusOK, ""},
+	})
+}
+
+// TestAuthenticateWithoutTokens checks that an unset api-token leaves the API closed rather than open.
+func TestAuthenticateWithoutTokens(t *testing.T) {
+	t.Setenv("INSD_API_TOKEN", "")
+	conf := loadConfig(zerolog.Nop())
+	tokens := append(conf.APITokens, validTokens(zerolog.Nop(), []APIToken{{Name: "empty", Token: "", Scope: ScopeAdmin}})...)
+	if len(tokens) != 0 {
+		t.Fatalf("default config accepts tokens %+v", tokens)
+	}
+	in := withTokens(t, tokens)
+	if tok := in.lookupToken(""); tok != nil {
+		t.Errorf("empty token matched %+v", tok)
+	}
+	runAuthCases(t, in, []authCase{
+		{"missing header", http.MethodGet, "/api/v1/challenges", "", http.StatusUnauthorized, CodeUnauthorized},
+		{"empty bearer", http.MethodGet, "/api/v1/challenges", "Bearer ", http.StatusUnauthorized, CodeUnauthorized},
+		{"bearer of whitespace", http.MethodGet, "/api/v1/challenges", "Bearer  ", http.StatusUnauthorized, CodeUnauthorized},
+		{"former default token", http.MethodGet, "/api/v1/instances", "Bearer token", http.StatusUnauthorized, CodeUnauthorized},
+		{"legacy route", http.MethodDelete, "/instances", "Bearer ", http.StatusUnauthorized, ""},
+		{"healthz", http.MethodGet, "/healthz", "", http.StatusOK, ""},
+	})
+}
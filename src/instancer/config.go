@@ -1,19 +1,60 @@
 package instancer
 
 import (
+	"net"
+	"os"
 	"strings"
+	"text/template"
+	"time"
 
 	"github.com/rs/zerolog"
 	"github.com/spf13/viper"
+	"github.com/ubcctf/instanced/src/k8s"
 )
 
 type Config struct {
-	InstanceTTL string
-	ListenAddr  string
-	LogLevel    zerolog.Level
-	LogRequests bool
-	DBFile      string
-	APIToken    string
+	InstanceTTL          time.Duration
+	InstanceMaxTTL       time.Duration
+	ExtendStep           time.Duration
+	MaxExtensions        int
+	TeamQuota            int
+	ClusterQuota         int
+	TeamRateLimit        float64
+	TeamRateBurst        int
+	IPRateLimit          float64
+	IPRateBurst          int
+	TrustedProxies       []*net.IPNet
+	InstanceCooldown     time.Duration
+	ListenAddr           string
+	LogLevel             zerolog.Level
+	LogRequests          bool
+	DBDriver             string
+	DBFile               string
+	DBDSN                string
+	RecordRetention      time.Duration
+	APIToken             string
+	APITokens            []APIToken
+	Namespace            string
+	EndpointTemplate     k8s.EndpointTemplate
+	IsolateNamespaces    bool
+	NamespacePrefix      string
+	NamespaceQuota       map[string]string
+	NamespaceIngressFrom map[string]string
+	ReconcileInterval    time.Duration
+	ReconcileGrace       time.Duration
+	ReconcileDryRun      bool
+	ReadyTimeout         time.Duration
+	LeaderElect          bool
+	LeaderLease          string
+	LeaderIdentity       string
+	LeaseDuration        time.Duration
+	LeaseRenewDeadline   time.Duration
+	LeaseRetryPeriod     time.Duration
+	JobWorkers           int
+	JobRetries           int
+	JobRetryBackoff      time.Duration
+	RequestTimeout       time.Duration
+	ShutdownTimeout      time.Duration
 }
 
 const DEFAULT_CONFIG_FILE = "instanced.yaml"
@@ -32,16 +73,86 @@ func loadConfig(log zerolog.Logger) Config {
 	// Set defaults
 	// How long each instance lasts by default
 	v.SetDefault("instance-expiry", "10m")
+	// Maximum lifetime of an instance by default
+	v.SetDefault("instance-max-expiry", "1h")
+	// How long each extension adds to an instance
+	v.SetDefault("instance-extend-step", "10m")
+	// Maximum number of times an instance may be extended
+	v.SetDefault("instance-max-extensions", 3)
+	// How long to wait for an instance to become ready before marking it failed
+	v.SetDefault("ready-timeout", "5m")
 	// Listen address for API server ip:port
 	v.SetDefault("listen-addr", ":8080")
 	// Zerolog log level string
 	v.SetDefault("log-level", "info")
 	// Log API requests
 	v.SetDefault("log-request", true)
+	// Deadline of the kubernetes and database calls made while handling an API request
+	v.SetDefault("request-timeout", "30s")
+	// How long to wait for API requests and background jobs to finish when shutting down
+	v.SetDefault("shutdown-timeout", "30s")
+	// Storage backend of instance records, sqlite, postgres or kubernetes
+	v.SetDefault("db-driver", "sqlite")
 	// Sqlite DB file path
 	v.SetDefault("db-file", "/data/instancer.db")
-	// API Auth Token
-	v.SetDefault("api-token", "token")
+	// PostgreSQL connection string, used with the postgres driver
+	v.SetDefault("db-dsn", "")
+	// How long the records of destroyed instances are kept, 0 to keep them forever
+	v.SetDefault("record-retention", "168h")
+	// API Auth Token, granted the admin scope. Unset by default, requests are rejected until a token is configured
+	v.SetDefault("api-token", "")
+	// Maximum number of active instances per team across all challenges, 0 for unlimited
+	v.SetDefault("quota-team", 0)
+	// Maximum number of active instances across all teams, 0 for unlimited
+	v.SetDefault("quota-cluster", 0)
+	// Create and delete requests allowed per minute for each team, and the burst size, 0 to disable
+	v.SetDefault("rate-limit-team", 10)
+	v.SetDefault("rate-limit-team-burst", 5)
+	// Create and delete requests allowed per minute for each client address, and the burst size, 0 to disable
+	v.SetDefault("rate-limit-ip", 0)
+	v.SetDefault("rate-limit-ip-burst", 10)
+	// CIDRs of proxies whose X-Forwarded-For header gives the client address, which is the connection address if empty
+	v.SetDefault("trusted-proxies", []string{})
+	// Time a team must wait after destroying an instance before recreating it, 0 to disable
+	v.SetDefault("instance-cooldown", "30s")
+	// Endpoint of instances of challenges which do not declare spec.endpoints, empty for none
+	v.SetDefault("endpoint-template", "https://{{.ID}}.{{.Challenge}}.ctf.maplebacon.org")
+	// Namespace containing challenge CRDs and shared instances
+	v.SetDefault("namespace", "challenges")
+	// Create a separate namespace for every instance
+	v.SetDefault("isolate-namespaces", false)
+	// Name prefix of per-instance namespaces
+	v.SetDefault("namespace-prefix", "instance-")
+	// ResourceQuota hard limits of per-instance namespaces
+	v.SetDefault("namespace-quota", map[string]string{"pods": "20", "services": "10"})
+	// Namespace labels allowed ingress into per-instance namespaces, e.g. the ingress controller
+	v.SetDefault("namespace-ingress-from", map[string]string{})
+
+	// How often to reconcile instance records with cluster objects, 0 to disable
+	v.SetDefault("reconcile-interval", "5m")
+	// Minimum age of objects and records before the reconciler acts on them
+	v.SetDefault("reconcile-grace", "2m")
+	// Log reconciler actions without deleting objects or marking records
+	v.SetDefault("reconcile-dry-run", false)
+
+	// Elect a leader among replicas to run the expiry and reconcile loops
+	v.SetDefault("leader-elect", false)
+	// Name of the Lease object in the challenge namespace used for leader election
+	v.SetDefault("leader-lease", "instanced-leader")
+	// Identity of this replica in the election, the hostname if empty
+	v.SetDefault("leader-identity", "")
+	// How long a lease is valid without renewal, and how long the leader keeps trying to renew it
+	v.SetDefault("lease-duration", "15s")
+	v.SetDefault("lease-renew-deadline", "10s")
+	// How often replicas try to acquire or renew the lease
+	v.SetDefault("lease-retry-period", "2s")
+
+	// Number of workers running background jobs such as deploying and destroying instances
+	v.SetDefault("job-workers", 8)
+	// Times a kubernetes request failing with a transient error is retried
+	v.SetDefault("job-retries", 3)
+	// Wait before the first retry, doubled for every following retry
+	v.SetDefault("job-retry-backoff", "1s")
 
 	// Read Config from file
 	err := v.ReadInConfig()
@@ -55,10 +166,157 @@ func loadConfig(log zerolog.Logger) Config {
 	if err != nil {
 		log.Warn().Err(err).Msg("error parsing config")
 	}
-	conf.InstanceTTL = v.GetString("instance-expiry")
+	conf.InstanceTTL, err = time.ParseDuration(v.GetString("instance-expiry"))
+	if err != nil {
+		log.Warn().Err(err).Msg("could not parse instance ttl, defaulting to 10 minutes")
+		conf.InstanceTTL = 10 * time.Minute
+	}
+	conf.InstanceMaxTTL, err = time.ParseDuration(v.GetString("instance-max-expiry"))
+	if err != nil {
+		log.Warn().Err(err).Msg("could not parse instance max ttl, defaulting to 1 hour")
+		conf.InstanceMaxTTL = time.Hour
+	}
+	if conf.InstanceMaxTTL < conf.InstanceTTL {
+		log.Warn().Msg("instance max ttl is less than instance ttl, raising it to match")
+		conf.InstanceMaxTTL = conf.InstanceTTL
+	}
+	conf.ExtendStep, err = time.ParseDuration(v.GetString("instance-extend-step"))
+	if err != nil {
+		log.Warn().Err(err).Msg("could not parse instance extend step, defaulting to 10 minutes")
+		conf.ExtendStep = 10 * time.Minute
+	}
+	conf.MaxExtensions = v.GetInt("instance-max-extensions")
+	conf.TeamQuota = v.GetInt("quota-team")
+	conf.ClusterQuota = v.GetInt("quota-cluster")
+	conf.TeamRateLimit = v.GetFloat64("rate-limit-team")
+	conf.TeamRateBurst = v.GetInt("rate-limit-team-burst")
+	conf.IPRateLimit = v.GetFloat64("rate-limit-ip")
+	conf.IPRateBurst = v.GetInt("rate-limit-ip-burst")
+	for _, cidr := range v.GetStringSlice("trusted-proxies") {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			log.Warn().Err(err).Str("cidr", cidr).Msg("ignoring invalid trusted proxy")
+			continue
+		}
+		conf.TrustedProxies = append(conf.TrustedProxies, ipNet)
+	}
+	conf.InstanceCooldown, err = time.ParseDuration(v.GetString("instance-cooldown"))
+	if err != nil {
+		log.Warn().Err(err).Msg("could not parse instance cooldown, defaulting to 30 seconds")
+		conf.InstanceCooldown = 30 * time.Second
+	}
+	conf.ReconcileInterval, err = time.ParseDuration(v.GetString("reconcile-interval"))
+	if err != nil {
+		log.Warn().Err(err).Msg("could not parse reconcile interval, defaulting to 5 minutes")
+		conf.ReconcileInterval = 5 * time.Minute
+	}
+	conf.ReconcileGrace, err = time.ParseDuration(v.GetString("reconcile-grace"))
+	if err != nil {
+		log.Warn().Err(err).Msg("could not parse reconcile grace, defaulting to 2 minutes")
+		conf.ReconcileGrace = 2 * time.Minute
+	}
+	conf.ReconcileDryRun = v.GetBool("reconcile-dry-run")
+	conf.ReadyTimeout, err = time.ParseDuration(v.GetString("ready-timeout"))
+	if err != nil {
+		log.Warn().Err(err).Msg("could not parse ready timeout, defaulting to 5 minutes")
+		conf.ReadyTimeout = 5 * time.Minute
+	}
+	conf.LeaderElect = v.GetBool("leader-elect")
+	conf.LeaderLease = v.GetString("leader-lease")
+	conf.LeaderIdentity = v.GetString("leader-identity")
+	if conf.LeaderIdentity == "" {
+		conf.LeaderIdentity, err = os.Hostname()
+		if err != nil {
+			log.Warn().Err(err).Msg("could not read hostname for leader identity")
+		}
+	}
+	conf.LeaseDuration, err = time.ParseDuration(v.GetString("lease-duration"))
+	if err != nil {
+		log.Warn().Err(err).Msg("could not parse lease duration, defaulting to 15 seconds")
+		conf.LeaseDuration = 15 * time.Second
+	}
+	conf.LeaseRenewDeadline, err = time.ParseDuration(v.GetString("lease-renew-deadline"))
+	if err != nil {
+		log.Warn().Err(err).Msg("could not parse lease renew deadline, defaulting to 10 seconds")
+		conf.LeaseRenewDeadline = 10 * time.Second
+	}
+	conf.LeaseRetryPeriod, err = time.ParseDuration(v.GetString("lease-retry-period"))
+	if err != nil {
+		log.Warn().Err(err).Msg("could not parse lease retry period, defaulting to 2 seconds")
+		conf.LeaseRetryPeriod = 2 * time.Second
+	}
+	conf.JobWorkers = v.GetInt("job-workers")
+	if conf.JobWorkers < 1 {
+		log.Warn().Int("workers", conf.JobWorkers).Msg("job workers must be positive, defaulting to 1")
+		conf.JobWorkers = 1
+	}
+	conf.JobRetries = v.GetInt("job-retries")
+	conf.JobRetryBackoff, err = time.ParseDuration(v.GetString("job-retry-backoff"))
+	if err != nil {
+		log.Warn().Err(err).Msg("could not parse job retry backoff, defaulting to 1 second")
+		conf.JobRetryBackoff = time.Second
+	}
+	conf.RequestTimeout, err = time.ParseDuration(v.GetString("request-timeout"))
+	if err != nil {
+		log.Warn().Err(err).Msg("could not parse request timeout, defaulting to 30 seconds")
+		conf.RequestTimeout = 30 * time.Second
+	}
+	conf.RecordRetention, err = time.ParseDuration(v.GetString("record-retention"))
+	if err != nil {
+		log.Warn().Err(err).Msg("could not parse record retention, defaulting to 7 days")
+		conf.RecordRetention = 7 * 24 * time.Hour
+	}
+	conf.ShutdownTimeout, err = time.ParseDuration(v.GetString("shutdown-timeout"))
+	if err != nil {
+		log.Warn().Err(err).Msg("could not parse shutdown timeout, defaulting to 30 seconds")
+		conf.ShutdownTimeout = 30 * time.Second
+	}
 	conf.ListenAddr = v.GetString("listen-addr")
 	conf.LogRequests = v.GetBool("log-request")
+	conf.DBDriver = v.GetString("db-driver")
 	conf.DBFile = v.GetString("db-file")
+	conf.DBDSN = v.GetString("db-dsn")
 	conf.APIToken = v.GetString("api-token")
+	conf.Namespace = v.GetString("namespace")
+	if tmplStr := v.GetString("endpoint-template"); tmplStr != "" {
+		tmpl, err := template.New("url").Option("missingkey=error").Parse(tmplStr)
+		if err != nil {
+			log.Warn().Err(err).Msg("could not parse endpoint template, instances without endpoints will have no url")
+		} else {
+			conf.EndpointTemplate = k8s.EndpointTemplate{Name: "url", Template: tmpl}
+		}
+	}
+	conf.IsolateNamespaces = v.GetBool("isolate-namespaces")
+	conf.NamespacePrefix = v.GetString("namespace-prefix")
+	conf.NamespaceQuota = v.GetStringMapString("namespace-quota")
+	conf.NamespaceIngressFrom = v.GetStringMapString("namespace-ingress-from")
+	err = v.UnmarshalKey("api-tokens", &conf.APITokens)
+	if err != nil {
+		log.Warn().Err(err).Msg("error parsing api tokens")
+	}
+	conf.APITokens = validTokens(log, conf.APITokens)
+	if conf.APIToken != "" {
+		conf.APITokens = append(conf.APITokens, APIToken{Name: "default", Token: conf.APIToken, Scope: ScopeAdmin})
+	}
+	if len(conf.APITokens) == 0 {
+		log.Warn().Msg("no api tokens configured, every authenticated request will be rejected")
+	}
 	return conf
 }
+
+// validTokens drops tokens which are empty or have an unknown scope.
+func validTokens(log zerolog.Logger, tokens []APIToken) []APIToken {
+	res := make([]APIToken, 0, len(tokens))
+	for _, t := range tokens {
+		if t.Token == "" {
+			log.Warn().Str("name", t.Name).Msg("ignoring api token with empty value")
+			continue
+		}
+		if t.Scope != ScopeAdmin && t.Scope != ScopeCTFd {
+			log.Warn().Str("name", t.Name).Str("scope", t.Scope).Msg("ignoring api token with unknown scope")
+			continue
+		}
+		res = append(res, t)
+	}
+	return res
+}
@@ -1,6 +1,9 @@
 package instancer
 
-import "fmt"
+import (
+	"errors"
+	"fmt"
+)
 
 type ChallengeNotFoundError struct {
 	chal string
@@ -9,3 +12,50 @@ type ChallengeNotFoundError struct {
 func (e *ChallengeNotFoundError) Error() string {
 	return fmt.Sprintf("challenge not found: %q", e.chal)
 }
+
+// ObjectRef identifies a single kubernetes object belonging to an instance.
+type ObjectRef struct {
+	Kind string `json:"kind"`
+	Name string `json:"name"`
+}
+
+// InstanceDeployError is returned when an object of an instance could not be created.
+// Objects created before the failure are rolled back; any that could not be removed are listed in RollbackErrs.
+type InstanceDeployError struct {
+	Challenge    string
+	Object       ObjectRef
+	Err          error
+	RollbackErrs []error
+}
+
+func (e *InstanceDeployError) Error() string {
+	msg := fmt.Sprintf("challenge %q: could not create %v %q: %v", e.Challenge, e.Object.Kind, e.Object.Name, e.Err)
+	if len(e.RollbackErrs) > 0 {
+		msg += fmt.Sprintf("; rollback incomplete: %v", errors.Join(e.RollbackErrs...))
+	}
+	return msg
+}
+
+func (e *InstanceDeployError) Unwrap() error {
+	return e.Err
+}
+
+// InstanceExtendError is returned when an instance may not be extended any further.
+type InstanceExtendError struct {
+	id     int64
+	reason string
+}
+
+func (e *InstanceExtendError) Error() string {
+	return fmt.Sprintf("instance %v cannot be extended: %v", e.id, e.reason)
+}
+
+// InstanceRestartError is returned when an instance cannot be restarted in its current state.
+type InstanceRestartError struct {
+	id     int64
+	reason string
+}
+
+func (e *InstanceRestartError) Error() string {
+	return fmt.Sprintf("instance %v cannot be restarted: %v", e.id, e.reason)
+}
@@ -2,10 +2,13 @@ package instancer
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"net/http"
 	"os"
 	"os/signal"
-	"text/template"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/labstack/echo/v4"
@@ -14,18 +17,30 @@ import (
 	"github.com/ubcctf/instanced/src/k8s"
 )
 
+// openStoreTimeout bounds opening and migrating the database at startup, which may wait on another replica
+// holding the migration lock.
+const openStoreTimeout = 5 * time.Minute
+
 type Instancer struct {
-	k8sC k8s.KubeClient
-	dbC  db.DBClient
-	srv  *echo.Echo
-	// challengeObjs map[string][]unstructured.Unstructured
-	challengeTmpls map[string]*template.Template
-	conf           Config
-	log            zerolog.Logger
+	k8sC       k8s.KubeClient
+	dbC        db.InstanceStore
+	srv        *echo.Echo
+	challenges *ChallengeRegistry
+	conf       Config
+	log        zerolog.Logger
+	// leading is set while this replica holds the leader lease
+	leading     atomic.Bool
+	teamLimiter *keyedLimiter
+	ipLimiter   *keyedLimiter
+	cooldowns   *cooldownTracker
+	purgeJobs   *purgeTracker
+	jobs        *jobQueue
 }
 
 func InitInstancer() *Instancer {
-	in := Instancer{}
+	in := Instancer{
+		challenges: NewChallengeRegistry(),
+	}
 
 	// Initial Logger
 	in.log = zerolog.New(zerolog.ConsoleWriter{Out: os.Stderr}).Level(zerolog.TraceLevel)
@@ -36,8 +51,14 @@ func InitInstancer() *Instancer {
 	// Set Config Log Level
 	in.log = in.log.Level(in.conf.LogLevel)
 
+	in.teamLimiter = newKeyedLimiter(in.conf.TeamRateLimit, in.conf.TeamRateBurst)
+	in.ipLimiter = newKeyedLimiter(in.conf.IPRateLimit, in.conf.IPRateBurst)
+	in.cooldowns = newCooldownTracker(in.conf.InstanceCooldown)
+	in.purgeJobs = newPurgeTracker()
+	in.jobs = newJobQueue(in.conf.JobWorkers, in.log)
+
 	// Set and configure API server
-	in.srv = initWebServer(in.log, in.conf.LogRequests)
+	in.srv = initWebServer(in.log, in.conf.LogRequests, in.conf.TrustedProxies)
 	in.registerRequestHandlers()
 
 	log := in.log.With().Str("component", "instanced-init").Logger()
@@ -51,9 +72,20 @@ func InitInstancer() *Instancer {
 	log.Debug().Str("config", fmt.Sprintf("%+v", in.k8sC)).Msg("loaded kube-api client config")
 
 	// Open DB connection
-	in.dbC, err = db.InitDB(in.conf.DBFile)
+	ctx, cancel := context.WithTimeout(context.Background(), openStoreTimeout)
+	defer cancel()
+	switch in.conf.DBDriver {
+	case "sqlite":
+		in.dbC, err = db.NewSQLiteStore(ctx, in.conf.DBFile)
+	case "postgres":
+		in.dbC, err = db.NewPostgresStore(ctx, in.conf.DBDSN)
+	case "kubernetes":
+		in.dbC, err = db.NewKubeStore(in.k8sC.RequestConfig(), in.conf.Namespace)
+	default:
+		err = fmt.Errorf("unknown database driver %q", in.conf.DBDriver)
+	}
 	if err != nil {
-		log.Fatal().Err(err).Msg("failed opening sqlite database")
+		log.Fatal().Err(err).Str("driver", in.conf.DBDriver).Msg("failed opening database")
 	}
 
 	return &in
@@ -64,13 +96,25 @@ func (in *Instancer) Start() {
 	log.Info().Msg("starting webserver...")
 	// Start Webserver
 	go func() {
-		if err := in.srv.Start(in.conf.ListenAddr); err != nil {
+		// Shutdown closes the server, which is not a failure
+		if err := in.srv.Start(in.conf.ListenAddr); err != nil && !errors.Is(err, http.ErrServerClosed) {
 			log.Fatal().Err(err).Msg("failed to start api server")
 		}
 	}()
 
 	quit := make(chan os.Signal, 1)
-	signal.Notify(quit, os.Interrupt)
+	signal.Notify(quit, os.Interrupt, syscall.SIGTERM)
+
+	// Watch challenge CRDs until shutdown
+	watchCtx, stopWatch := context.WithCancel(context.Background())
+	defer stopWatch()
+	go in.WatchCRDs(watchCtx)
+
+	if in.conf.LeaderElect {
+		go in.RunLeaderElection(watchCtx)
+	} else {
+		leaderGauge.Set(1)
+	}
 
 	log.Info().Msg("starting instance monitoring loop")
 
@@ -78,20 +122,55 @@ func (in *Instancer) Start() {
 	checkExpired := time.NewTicker(time.Second * 60)
 	defer checkExpired.Stop()
 
+	// Ticker to reconcile instance records with cluster objects
+	var reconcile <-chan time.Time
+	if in.conf.ReconcileInterval > 0 {
+		reconcileTicker := time.NewTicker(in.conf.ReconcileInterval)
+		defer reconcileTicker.Stop()
+		reconcile = reconcileTicker.C
+	}
+
 	for {
 		select {
 		case <-checkExpired.C:
-			// todo, add cancel to this
+			if !in.isLeader() {
+				continue
+			}
+			// A run still queued behind a slow one is not queued again
 			log.Info().Msg("checking for expired instances...")
-			go in.DestoryExpiredInstances()
+			in.jobs.enqueueOnce(JobExpire, JobExpire, func(ctx context.Context) error {
+				in.DestoryExpiredInstances(ctx)
+				in.PruneInstanceRecords(ctx)
+				return nil
+			})
+
+		case <-reconcile:
+			if !in.isLeader() {
+				continue
+			}
+			log.Info().Msg("reconciling instances...")
+			in.jobs.enqueueOnce(JobReconcile, JobReconcile, func(ctx context.Context) error {
+				in.ReconcileInstances(ctx)
+				return nil
+			})
 
 		case <-quit:
-			// Graceful shutdown http server
-			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			log.Info().Msg("shutting down...")
+			// Release the leader lease before shutting down
+			stopWatch()
+			ctx, cancel := context.WithTimeout(context.Background(), in.conf.ShutdownTimeout)
 			defer cancel()
+			// Graceful shutdown http server, waiting for requests in flight
 			if err := in.srv.Shutdown(ctx); err != nil {
 				log.Error().Err(err).Msg("failed graceful shutdown")
 			}
+			// Cancel background jobs and wait for them to record their outcome
+			if err := in.jobs.close(ctx); err != nil {
+				log.Error().Err(err).Msg("background jobs did not finish before shutdown")
+			}
+			if err := in.dbC.Close(); err != nil {
+				log.Error().Err(err).Msg("error closing database")
+			}
 			return
 		}
 	}
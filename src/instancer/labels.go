@@ -0,0 +1,76 @@
+package instancer
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/ubcctf/instanced/src/db"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+const (
+	LabelManagedBy  = "app.kubernetes.io/managed-by"
+	LabelInstanceID = "instanced.maplebacon.org/instance-id"
+	LabelChallenge  = "instanced.maplebacon.org/challenge"
+	LabelTeam       = "instanced.maplebacon.org/team"
+
+	managedByValue = "instanced"
+)
+
+var invalidLabelChars = regexp.MustCompile(`[^A-Za-z0-9._-]`)
+
+// labelValue converts s into a valid kubernetes label value.
+func labelValue(s string) string {
+	s = invalidLabelChars.ReplaceAllString(s, "_")
+	if len(s) > 63 {
+		s = s[:63]
+	}
+	return strings.Trim(s, "._-")
+}
+
+// instanceLabels returns the ownership labels stamped on every object of an instance.
+func instanceLabels(rec db.InstanceRecord) map[string]string {
+	return map[string]string{
+		LabelManagedBy:  managedByValue,
+		LabelInstanceID: labelValue(rec.UUID),
+		LabelChallenge:  labelValue(rec.Challenge),
+		LabelTeam:       labelValue(rec.TeamID),
+	}
+}
+
+// instanceSelector returns a label selector matching every object of an instance.
+func instanceSelector(rec db.InstanceRecord) string {
+	return labels.SelectorFromSet(labels.Set{
+		LabelManagedBy:  managedByValue,
+		LabelInstanceID: labelValue(rec.UUID),
+	}).String()
+}
+
+// setInstanceLabels adds the ownership labels of an instance to obj, keeping any labels set by the template.
+// The pod template of a workload is labelled as well, so its pods can be found when waiting for the instance to become ready.
+func setInstanceLabels(obj *unstructured.Unstructured, rec db.InstanceRecord) {
+	obj.SetLabels(mergeLabels(obj.GetLabels(), instanceLabels(rec)))
+
+	podLabels, found, err := unstructured.NestedStringMap(obj.Object, "spec", "template", "metadata", "labels")
+	if err != nil {
+		return
+	}
+	if !found {
+		if _, ok, _ := unstructured.NestedMap(obj.Object, "spec", "template"); !ok {
+			return
+		}
+	}
+	_ = unstructured.SetNestedStringMap(obj.Object, mergeLabels(podLabels, instanceLabels(rec)), "spec", "template", "metadata", "labels")
+}
+
+// mergeLabels adds extra to objLabels, which may be nil.
+func mergeLabels(objLabels map[string]string, extra map[string]string) map[string]string {
+	if objLabels == nil {
+		objLabels = make(map[string]string, len(extra))
+	}
+	for k, v := range extra {
+		objLabels[k] = v
+	}
+	return objLabels
+}
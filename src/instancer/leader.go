@@ -0,0 +1,56 @@
+package instancer
+
+import (
+	"context"
+
+	"k8s.io/client-go/tools/leaderelection"
+)
+
+// isLeader reports whether this replica should run the expiry and reconcile loops and write challenge statuses.
+// Without leader election every replica is its own leader.
+func (in *Instancer) isLeader() bool {
+	return !in.conf.LeaderElect || in.leading.Load()
+}
+
+// RunLeaderElection campaigns for the leader Lease until ctx is cancelled.
+// A replica losing the lease steps down and campaigns again. The lease is released on cancellation
+// so another replica can take over without waiting for it to expire.
+func (in *Instancer) RunLeaderElection(ctx context.Context) {
+	log := in.log.With().Str("component", "instanced-leader").Str("identity", in.conf.LeaderIdentity).Logger()
+
+	lock, err := in.k8sC.NewLeaseLock(in.conf.Namespace, in.conf.LeaderLease, in.conf.LeaderIdentity)
+	if err != nil {
+		log.Fatal().Err(err).Msg("could not create leader election lock")
+	}
+	elector, err := leaderelection.NewLeaderElector(leaderelection.LeaderElectionConfig{
+		Lock:            lock,
+		LeaseDuration:   in.conf.LeaseDuration,
+		RenewDeadline:   in.conf.LeaseRenewDeadline,
+		RetryPeriod:     in.conf.LeaseRetryPeriod,
+		ReleaseOnCancel: true,
+		Name:            in.conf.LeaderLease,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(ctx context.Context) {
+				log.Info().Msg("became leader")
+				in.leading.Store(true)
+				leaderGauge.Set(1)
+			},
+			OnStoppedLeading: func() {
+				log.Info().Msg("stopped leading")
+				in.leading.Store(false)
+				leaderGauge.Set(0)
+			},
+			OnNewLeader: func(identity string) {
+				log.Info().Str("leader", identity).Msg("leader elected")
+			},
+		},
+	})
+	if err != nil {
+		log.Fatal().Err(err).Msg("invalid leader election config")
+	}
+
+	// Run returns whenever leadership is lost
+	for ctx.Err() == nil {
+		elector.Run(ctx)
+	}
+}
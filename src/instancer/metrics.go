@@ -0,0 +1,86 @@
+package instancer
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	reconcileRuns = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "instanced",
+		Subsystem: "reconcile",
+		Name:      "runs_total",
+		Help:      "Number of reconciliation runs between the database and the cluster.",
+	})
+	reconcileOrphans = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "instanced",
+		Subsystem: "reconcile",
+		Name:      "orphaned_objects_total",
+		Help:      "Number of cluster objects found without an instance record.",
+	}, []string{"kind", "dry_run"})
+	reconcileMissing = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "instanced",
+		Subsystem: "reconcile",
+		Name:      "missing_instances_total",
+		Help:      "Number of instance records found without cluster objects.",
+	}, []string{"dry_run"})
+	reconcileErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "instanced",
+		Subsystem: "reconcile",
+		Name:      "errors_total",
+		Help:      "Number of errors encountered while reconciling.",
+	})
+	rateLimitRejected = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "instanced",
+		Subsystem: "ratelimit",
+		Name:      "rejected_total",
+		Help:      "Number of requests rejected by a rate limit or cooldown.",
+	}, []string{"limit", "method"})
+	leaderGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "instanced",
+		Name:      "leader",
+		Help:      "Whether this replica holds the leader lease and runs the expiry and reconcile loops.",
+	})
+	jobQueueDepth = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "instanced",
+		Subsystem: "jobs",
+		Name:      "queued",
+		Help:      "Number of background jobs waiting for a worker.",
+	})
+	jobsRunning = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "instanced",
+		Subsystem: "jobs",
+		Name:      "running",
+		Help:      "Number of background jobs being run by a worker.",
+	})
+	jobsDetached = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "instanced",
+		Subsystem: "jobs",
+		Name:      "detached",
+		Help:      "Number of background jobs waiting outside the worker pool, such as instances waiting to become ready.",
+	})
+	jobWait = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "instanced",
+		Subsystem: "jobs",
+		Name:      "wait_seconds",
+		Help:      "Time background jobs spent queued before a worker started them.",
+		Buckets:   prometheus.ExponentialBuckets(0.01, 4, 8),
+	}, []string{"kind"})
+	jobDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "instanced",
+		Subsystem: "jobs",
+		Name:      "duration_seconds",
+		Help:      "Time taken to run background jobs.",
+		Buckets:   prometheus.ExponentialBuckets(0.05, 4, 8),
+	}, []string{"kind", "result"})
+	apiserverRetries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "instanced",
+		Subsystem: "jobs",
+		Name:      "apiserver_retries_total",
+		Help:      "Number of kubernetes requests retried after a transient error.",
+	}, []string{"operation"})
+)
+
+func init() {
+	prometheus.MustRegister(reconcileRuns, reconcileOrphans, reconcileMissing, reconcileErrors, rateLimitRejected, leaderGauge,
+		jobQueueDepth, jobsRunning, jobsDetached, jobWait, jobDuration, apiserverRetries)
+}
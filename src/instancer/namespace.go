@@ -0,0 +1,94 @@
+package instancer
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/ubcctf/instanced/src/db"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+var invalidNamespaceChars = regexp.MustCompile(`[^a-z0-9-]`)
+
+// instanceNamespaceName returns the name of the dedicated namespace of an instance.
+// The result is a valid DNS-1123 label, truncating the challenge name if needed.
+func (in *Instancer) instanceNamespaceName(challenge string, cuuid string) string {
+	chal := invalidNamespaceChars.ReplaceAllString(strings.ToLower(challenge), "-")
+	maxChal := 63 - len(in.conf.NamespacePrefix) - len(cuuid) - 1
+	if maxChal < 0 {
+		maxChal = 0
+	}
+	if len(chal) > maxChal {
+		chal = chal[:maxChal]
+	}
+	return strings.Trim(fmt.Sprintf("%v%v-%v", in.conf.NamespacePrefix, chal, cuuid), "-")
+}
+
+// instanceNamespaceObjs returns the objects making up the dedicated namespace of an instance, in creation order:
+// the namespace itself, a NetworkPolicy denying ingress from other namespaces, and a ResourceQuota.
+func (in *Instancer) instanceNamespaceObjs(rec db.InstanceRecord) []*unstructured.Unstructured {
+	namespace := rec.Namespace
+	labels := make(map[string]interface{})
+	for k, v := range instanceLabels(rec) {
+		labels[k] = v
+	}
+
+	ns := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "Namespace",
+		"metadata": map[string]interface{}{
+			"name":   namespace,
+			"labels": labels,
+		},
+	}}
+
+	// Pods in the namespace may always reach each other
+	from := []interface{}{
+		map[string]interface{}{"podSelector": map[string]interface{}{}},
+	}
+	if len(in.conf.NamespaceIngressFrom) > 0 {
+		matchLabels := make(map[string]interface{}, len(in.conf.NamespaceIngressFrom))
+		for k, v := range in.conf.NamespaceIngressFrom {
+			matchLabels[k] = v
+		}
+		from = append(from, map[string]interface{}{
+			"namespaceSelector": map[string]interface{}{"matchLabels": matchLabels},
+		})
+	}
+	netpol := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "networking.k8s.io/v1",
+		"kind":       "NetworkPolicy",
+		"metadata": map[string]interface{}{
+			"name":      "default-deny",
+			"namespace": namespace,
+			"labels":    labels,
+		},
+		"spec": map[string]interface{}{
+			"podSelector": map[string]interface{}{},
+			"policyTypes": []interface{}{"Ingress"},
+			"ingress": []interface{}{
+				map[string]interface{}{"from": from},
+			},
+		},
+	}}
+
+	hard := make(map[string]interface{}, len(in.conf.NamespaceQuota))
+	for k, v := range in.conf.NamespaceQuota {
+		hard[k] = v
+	}
+	quota := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "ResourceQuota",
+		"metadata": map[string]interface{}{
+			"name":      "instance-quota",
+			"namespace": namespace,
+			"labels":    labels,
+		},
+		"spec": map[string]interface{}{
+			"hard": hard,
+		},
+	}}
+
+	return []*unstructured.Unstructured{ns, netpol, quota}
+}
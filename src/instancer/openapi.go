@@ -0,0 +1,18 @@
+package instancer
+
+import (
+	_ "embed"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+)
+
+// openAPISpec is the OpenAPI 3 document describing every route registered by registerRequestHandlers.
+// It must be updated whenever a route is added, which TestOpenAPICoversRoutes enforces.
+//
+//go:embed openapi.json
+var openAPISpec []byte
+
+func (in *Instancer) handleOpenAPI(c echo.Context) error {
+	return c.Blob(http.StatusOK, echo.MIMEApplicationJSONCharsetUTF8, openAPISpec)
+}
@@ -0,0 +1,250 @@
+package instancer
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/ubcctf/instanced/src/db"
+)
+
+var (
+	routeParam = regexp.MustCompile(`:([A-Za-z_]+)`)
+
+	testInstancer     *Instancer
+	testInstancerOnce sync.Once
+)
+
+// testServer returns an Instancer with every route registered.
+// It is shared since the prometheus middleware may only be registered once.
+func testServer() *Instancer {
+	testInstancerOnce.Do(func() {
+		in := &Instancer{challenges: NewChallengeRegistry(), log: zerolog.Nop()}
+		in.srv = initWebServer(in.log, false, nil)
+		in.registerRequestHandlers()
+		testInstancer = in
+	})
+	return testInstancer
+}
+
+type openAPIPaths struct {
+	Paths map[string]map[string]json.RawMessage `json:"paths"`
+}
+
+// registeredRoutes returns the paths of the registered routes in OpenAPI form with their lowercase methods.
+func registeredRoutes(in *Instancer) map[string]map[string]bool {
+	routes := make(map[string]map[string]bool)
+	for _, r := range in.srv.Routes() {
+		// echo registers catch-all handlers under pseudo methods
+		if !isHTTPMethod(r.Method) {
+			continue
+		}
+		path := routeParam.ReplaceAllString(r.Path, "{$1}")
+		if routes[path] == nil {
+			routes[path] = make(map[string]bool)
+		}
+		routes[path][strings.ToLower(r.Method)] = true
+	}
+	return routes
+}
+
+// TestOpenAPICoversRoutes fails if a registered route is missing from openapi.json.
+func TestOpenAPICoversRoutes(t *testing.T) {
+	var spec openAPIPaths
+	if err := json.Unmarshal(openAPISpec, &spec); err != nil {
+		t.Fatalf("openapi.json is not valid JSON: %v", err)
+	}
+
+	for path, methods := range registeredRoutes(testServer()) {
+		for method := range methods {
+			if _, ok := spec.Paths[path][method]; !ok {
+				t.Errorf("route %v %v is missing from openapi.json", strings.ToUpper(method), path)
+			}
+		}
+	}
+}
+
+// TestOpenAPIRoutesExist fails if openapi.json describes a route which is not registered.
+func TestOpenAPIRoutesExist(t *testing.T) {
+	var spec openAPIPaths
+	if err := json.Unmarshal(openAPISpec, &spec); err != nil {
+		t.Fatalf("openapi.json is not valid JSON: %v", err)
+	}
+
+	routes := registeredRoutes(testServer())
+	for path, item := range spec.Paths {
+		for method := range item {
+			// Path items may also hold shared parameters and descriptions
+			if !isHTTPMethod(strings.ToUpper(method)) {
+				continue
+			}
+			if !routes[path][method] {
+				t.Errorf("openapi.json describes %v %v, which is not a registered route", strings.ToUpper(method), path)
+			}
+		}
+	}
+}
+
+// schemaTypes are the types described by the object schemas of openapi.json, by schema name.
+var schemaTypes = map[string]reflect.Type{
+	"Endpoint":               reflect.TypeOf(db.Endpoint{}),
+	"ObjectKind":             reflect.TypeOf(db.ObjectKind{}),
+	"InstanceRecord":         reflect.TypeOf(db.InstanceRecord{}),
+	"InstanceResponse":       reflect.TypeOf(InstanceResponse{}),
+	"ChallengeResponse":      reflect.TypeOf(ChallengeResponse{}),
+	"TeamChallengeResponse":  reflect.TypeOf(TeamChallengeResponse{}),
+	"CreateInstanceRequest":  reflect.TypeOf(CreateInstanceRequest{}),
+	"APIError":               reflect.TypeOf(APIError{}),
+	"APIErrorResponse":       reflect.TypeOf(APIErrorResponse{}),
+	"ErrorResponse":          reflect.TypeOf(ErrorResponse{}),
+	"InstancesResponse":      reflect.TypeOf(InstancesResponse{}),
+	"InstanceStatusResponse": reflect.TypeOf(InstanceStatusResponse{}),
+	"ExtendResponse":         reflect.TypeOf(ExtendResponse{}),
+	"QuotaExceededResponse":  reflect.TypeOf(QuotaExceededResponse{}),
+	"RateLimitedResponse":    reflect.TypeOf(RateLimitedResponse{}),
+	"PurgeRequest":           reflect.TypeOf(PurgeRequest{}),
+	"PurgeFilter":            reflect.TypeOf(PurgeFilter{}),
+	"PurgeFailure":           reflect.TypeOf(PurgeFailure{}),
+	"PurgeJob":               reflect.TypeOf(PurgeJob{}),
+	"PurgePreviewResponse":   reflect.TypeOf(PurgePreviewResponse{}),
+}
+
+type openAPISchema struct {
+	Type       string                     `json:"type"`
+	Properties map[string]json.RawMessage `json:"properties"`
+	Required   []string                   `json:"required"`
+}
+
+// fillValue sets every exported field reachable from v to a non-zero value, so no field is omitted when marshalled.
+func fillValue(v reflect.Value) {
+	if v.Type() == reflect.TypeOf(time.Time{}) {
+		v.Set(reflect.ValueOf(time.Unix(1, 0)))
+		return
+	}
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString("x")
+	case reflect.Bool:
+		v.SetBool(true)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		v.SetInt(1)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		v.SetUint(1)
+	case reflect.Interface:
+		v.Set(reflect.ValueOf("x"))
+	case reflect.Pointer:
+		v.Set(reflect.New(v.Type().Elem()))
+		fillValue(v.Elem())
+	case reflect.Slice:
+		v.Set(reflect.MakeSlice(v.Type(), 1, 1))
+		fillValue(v.Index(0))
+	case reflect.Map:
+		v.Set(reflect.MakeMap(v.Type()))
+		key, elem := reflect.New(v.Type().Key()).Elem(), reflect.New(v.Type().Elem()).Elem()
+		fillValue(key)
+		fillValue(elem)
+		v.SetMapIndex(key, elem)
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			if v.Type().Field(i).IsExported() {
+				fillValue(v.Field(i))
+			}
+		}
+	}
+}
+
+// jsonKeys returns the sorted keys of the JSON object v is marshalled to.
+func jsonKeys(t *testing.T, v reflect.Value) []string {
+	t.Helper()
+	b, err := json.Marshal(v.Interface())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var obj map[string]json.RawMessage
+	if err := json.Unmarshal(b, &obj); err != nil {
+		t.Fatalf("%v is not marshalled to an object: %v", v.Type(), err)
+	}
+	keys := make([]string, 0, len(obj))
+	for k := range obj {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// TestOpenAPISchemasMatchTypes fails if the properties of an object schema in openapi.json differ from the JSON fields
+// of its type, or if a required property is omitted when empty.
+func TestOpenAPISchemasMatchTypes(t *testing.T) {
+	var spec struct {
+		Components struct {
+			Schemas map[string]openAPISchema `json:"schemas"`
+		} `json:"components"`
+	}
+	if err := json.Unmarshal(openAPISpec, &spec); err != nil {
+		t.Fatalf("openapi.json is not valid JSON: %v", err)
+	}
+
+	for name := range schemaTypes {
+		if _, ok := spec.Components.Schemas[name]; !ok {
+			t.Errorf("openapi.json has no schema %v", name)
+		}
+	}
+	for name, schema := range spec.Components.Schemas {
+		if schema.Type != "object" {
+			continue
+		}
+		typ, ok := schemaTypes[name]
+		if !ok {
+			t.Errorf("schema %v has no type to check it against, add it to schemaTypes", name)
+			continue
+		}
+
+		props := make([]string, 0, len(schema.Properties))
+		for p := range schema.Properties {
+			props = append(props, p)
+		}
+		sort.Strings(props)
+		filled := reflect.New(typ).Elem()
+		fillValue(filled)
+		if fields := jsonKeys(t, filled); !reflect.DeepEqual(props, fields) {
+			t.Errorf("schema %v has properties %v, but %v has fields %v", name, props, typ, fields)
+		}
+
+		empty := jsonKeys(t, reflect.New(typ).Elem())
+		for _, r := range schema.Required {
+			if i := sort.SearchStrings(empty, r); i == len(empty) || empty[i] != r {
+				t.Errorf("schema %v requires %v, which an empty %v omits", name, r, typ)
+			}
+		}
+	}
+}
+
+func TestOpenAPIServedWithoutAuth(t *testing.T) {
+	in := testServer()
+
+	rec := httptest.NewRecorder()
+	in.srv.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/openapi.json", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET /openapi.json returned %v", rec.Code)
+	}
+	if !json.Valid(rec.Body.Bytes()) {
+		t.Fatal("GET /openapi.json did not return JSON")
+	}
+}
+
+func isHTTPMethod(m string) bool {
+	switch m {
+	case http.MethodGet, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete,
+		http.MethodHead, http.MethodOptions:
+		return true
+	}
+	return false
+}
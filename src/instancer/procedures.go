@@ -5,32 +5,75 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"slices"
 	"time"
 
 	"github.com/google/uuid"
 	"github.com/ubcctf/instanced/src/db"
 	"github.com/ubcctf/instanced/src/k8s"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
 )
 
 func (in *Instancer) LoadCRDs(ctx context.Context) {
 	log := in.log
 	// Test CRDs
 	log.Debug().Msg("querying CRDs")
-	var err error
-	in.challengeTmpls, err = in.k8sC.QueryInstancedChallenges(ctx, "challenges")
+	challenges, rejected, err := in.k8sC.QueryInstancedChallenges(ctx, in.conf.Namespace)
 	if err != nil {
-		log.Debug().Err(err).Msg("error retrieving challenge definitions from CRDs")
+		log.Error().Err(err).Msg("error retrieving challenge definitions from CRDs")
+		return
+	}
+	diff := in.challenges.Replace(challenges, rejected)
+	for k, v := range challenges {
+		log.Info().Str("challenge", k).
+			Dur("ttl", in.challengeTTL(v)).
+			Dur("max-ttl", in.challengeMaxTTL(v)).
+			Msg("parsed challenge template")
+	}
+	if diff.empty() {
+		log.Debug().Int("count", len(challenges)).Strs("rejected", rejected).Msg("parsed challenges, none changed")
+		return
+	}
+	log.Info().Int("count", len(challenges)).
+		Strs("added", diff.Added).
+		Strs("updated", diff.Updated).
+		Strs("removed", diff.Removed).
+		Strs("rejected", rejected).
+		Msg("parsed challenges")
+}
+
+// enqueueReload reloads the challenge CRDs in the background, unless a reload is already waiting.
+func (in *Instancer) enqueueReload() {
+	in.jobs.enqueueOnce(JobReload, JobReload, func(ctx context.Context) error {
+		in.LoadCRDs(ctx)
+		return nil
+	})
+}
+
+// challengeTTL returns the default lifetime of an instance of a challenge,
+// falling back to the global instance ttl when the challenge does not set one.
+func (in *Instancer) challengeTTL(def k8s.ChallengeDefinition) time.Duration {
+	ttl := def.Expiry
+	if ttl == 0 {
+		ttl = in.conf.InstanceTTL
 	}
-	for k := range in.challengeTmpls {
-		log.Info().Str("challenge", k).Msg("parsed challenge template")
+	return min(ttl, in.challengeMaxTTL(def))
+}
+
+// challengeMaxTTL returns the maximum total lifetime of an instance of a challenge,
+// falling back to the global instance max ttl when the challenge does not set one.
+func (in *Instancer) challengeMaxTTL(def k8s.ChallengeDefinition) time.Duration {
+	if def.MaxExpiry != 0 {
+		return def.MaxExpiry
 	}
-	log.Info().Int("count", len(in.challengeTmpls)).Msg("parsed challenges")
+	return max(in.conf.InstanceMaxTTL, def.Expiry)
 }
 
-func (in *Instancer) DestoryExpiredInstances() {
+func (in *Instancer) DestoryExpiredInstances(ctx context.Context) {
 	log := in.log.With().Str("component", "instanced").Logger()
-	instances, err := in.dbC.ReadInstanceRecords()
+	instances, err := in.dbC.ReadInstanceRecords(ctx)
 	if err != nil {
 		log.Error().Err(err).Msg("error reading instance records")
 		return
@@ -41,128 +84,662 @@ func (in *Instancer) DestoryExpiredInstances() {
 		log.Debug().Int64("id", i.Id).Time("expiry", i.Expiry).Str("challenge", i.Challenge).Msg("instance record found")
 		if time.Now().After(i.Expiry) {
 			log.Info().Int64("id", i.Id).Str("challenge", i.Challenge).Msg("destroying expired instance")
-			err := in.DestroyInstance(i)
-			if err != nil {
-				log.Error().Err(err).Msg("error destroying instance")
-			}
+			in.enqueueDestroy(i.Id, nil)
 		}
 	}
 }
 
-func (in *Instancer) DestroyInstance(rec db.InstanceRecord) error {
+// PruneInstanceRecords deletes the records of instances destroyed longer than the record retention ago.
+func (in *Instancer) PruneInstanceRecords(ctx context.Context) {
+	if in.conf.RecordRetention <= 0 {
+		return
+	}
 	log := in.log.With().Str("component", "instanced").Logger()
-	/* 	chal, ok := in.challengeObjs[rec.Challenge]
-	   	if !ok {
-	   		return &ChallengeNotFoundError{rec.Challenge}
-	   	} */
-	chal, err := in.GetChalObjsFromTemplate(rec.Challenge, rec.UUID)
+	n, err := in.dbC.PruneInstanceRecords(ctx, time.Now().Add(-in.conf.RecordRetention))
 	if err != nil {
+		log.Error().Err(err).Msg("error pruning destroyed instance records")
+	}
+	if n > 0 {
+		log.Info().Int("count", n).Msg("pruned destroyed instance records")
+	}
+}
+
+// QueueDestroyInstance destroys an instance through the job queue and waits for the result, or until ctx is done.
+// A deploy or restart of the instance which has not finished is cancelled first.
+func (in *Instancer) QueueDestroyInstance(ctx context.Context, id int64) error {
+	key := instanceKey(id)
+	in.jobs.preempt(key, JobDeploy, JobRestart, JobReady)
+	return in.jobs.do(ctx, key, JobDestroy, in.destroyJob(id))
+}
+
+// enqueueDestroy destroys an instance through the job queue without waiting, calling done with the result if it is set.
+// A deploy or restart of the instance which has not finished is cancelled first.
+func (in *Instancer) enqueueDestroy(id int64, done func(error)) {
+	key := instanceKey(id)
+	in.jobs.preempt(key, JobDeploy, JobRestart, JobReady)
+	destroy := in.destroyJob(id)
+	if done == nil {
+		in.jobs.enqueueOnce(key, JobDestroy, destroy)
+		return
+	}
+	queued := in.jobs.enqueue(key, JobDestroy, func(ctx context.Context) error {
+		err := destroy(ctx)
+		done(err)
 		return err
+	})
+	if !queued {
+		done(ErrQueueClosed)
 	}
+}
 
-	for _, o := range chal {
-		obj := o.DeepCopy()
-		// todo: set proper name
-		//obj.SetName(fmt.Sprintf("in-%v-%v", obj.GetName(), rec.Id))
-		err := in.k8sC.DeleteObject(obj, "challenges")
+// destroyJob returns a job destroying an instance. The record is read when the job runs,
+// since earlier jobs of the instance may have changed its state.
+func (in *Instancer) destroyJob(id int64) jobFunc {
+	return func(ctx context.Context) error {
+		// A preempted wait for the instance to become ready may still be recording the deploy as failed
+		if err := in.jobs.awaitPreempted(ctx, instanceKey(id)); err != nil {
+			return err
+		}
+		rec, err := in.dbC.ReadInstanceRecord(ctx, id)
+		if err != nil {
+			return err
+		}
+		if rec.State == db.StateDestroyed {
+			return nil
+		}
+		return in.DestroyInstance(ctx, rec)
+	}
+}
+
+// DestroyInstance deletes the objects of an instance and marks it destroyed.
+// If any object could not be deleted the instance is left terminating so destroying it can be retried.
+// Callers other than jobs of the instance should use QueueDestroyInstance.
+func (in *Instancer) DestroyInstance(ctx context.Context, rec db.InstanceRecord) error {
+	log := in.log.With().Str("component", "instanced").Int64("id", rec.Id).Logger()
+	rec, err := in.transitionInstance(ctx, rec, db.StateTerminating, nil)
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	if rec.Isolated {
+		// Deleting the namespace removes every object of the instance
+		ns := in.instanceNamespaceObjs(rec)[0]
+		err := in.retryTransient(ctx, "delete", func() error {
+			return in.k8sC.DeleteObject(ctx, ns, "")
+		})
+		if err != nil && !apierrors.IsNotFound(err) {
+			log.Warn().Err(err).Str("namespace", rec.Namespace).Msg("error deleting instance namespace")
+			errs = append(errs, err)
+		}
+	} else if len(rec.Kinds) > 0 {
+		errs = in.deleteObjsByLabel(ctx, rec)
+	} else {
+		// Records created before objects were labelled can only be removed by name
+		chal, err := in.GetChalObjsFromTemplate(rec.Challenge, k8s.ChalInstIdentifier{ID: rec.UUID, Challenge: rec.Challenge, Namespace: rec.Namespace})
 		if err != nil {
-			log.Warn().Err(err).Str("name", obj.GetName()).Str("kind", obj.GetKind()).Msg("error deleting object")
+			return err
+		}
+
+		for _, o := range chal {
+			obj := o.DeepCopy()
+			err := in.retryTransient(ctx, "delete", func() error {
+				return in.k8sC.DeleteObject(ctx, obj, rec.Namespace)
+			})
+			if err != nil && !apierrors.IsNotFound(err) {
+				log.Warn().Err(err).Str("name", obj.GetName()).Str("kind", obj.GetKind()).Msg("error deleting object")
+				errs = append(errs, err)
+			}
+		}
+	}
+	if len(errs) > 0 {
+		err := errors.Join(errs...)
+		// The failure is recorded even if the destroy was cancelled
+		cctx, cancel := cleanupContext(ctx)
+		defer cancel()
+		_, terr := in.transitionInstance(cctx, rec, db.StateTerminating, err)
+		if terr != nil {
+			log.Warn().Err(terr).Msg("error recording instance destroy failure")
 		}
+		return err
 	}
-	err = in.dbC.DeleteInstanceRecord(rec.Id)
+
+	_, err = in.transitionInstance(ctx, rec, db.StateDestroyed, nil)
 	if err != nil {
-		log.Warn().Err(err).Msg("error deleting instance record")
+		log.Warn().Err(err).Msg("error marking instance destroyed")
+		return err
 	}
 	return nil
 }
 
-func (in *Instancer) CreateInstance(challenge, team string) (db.InstanceRecord, error) {
+// deleteObjsByLabel deletes the objects of each kind of an instance selected by its labels.
+// Errors are collected and returned rather than aborting the deletion.
+func (in *Instancer) deleteObjsByLabel(ctx context.Context, rec db.InstanceRecord) []error {
+	log := in.log.With().Str("component", "instanced").Int64("id", rec.Id).Logger()
+	var errs []error
+	selector := instanceSelector(rec)
+	for _, k := range rec.Kinds {
+		gvk := schema.FromAPIVersionAndKind(k.APIVersion, k.Kind)
+		var n int
+		err := in.retryTransient(ctx, "delete", func() (err error) {
+			n, err = in.k8sC.DeleteObjectsByLabel(ctx, gvk, rec.Namespace, selector)
+			return err
+		})
+		if err != nil {
+			log.Warn().Err(err).Str("kind", k.Kind).Str("selector", selector).Msg("error deleting objects")
+			errs = append(errs, err)
+		}
+		log.Debug().Int("count", n).Str("kind", k.Kind).Msg("deleted objects")
+	}
+	return errs
+}
+
+// objectKinds returns the distinct kinds of objs in order of first appearance.
+func objectKinds(objs []unstructured.Unstructured) []db.ObjectKind {
+	kinds := make([]db.ObjectKind, 0)
+	seen := make(map[db.ObjectKind]bool)
+	for _, o := range objs {
+		k := db.ObjectKind{APIVersion: o.GetAPIVersion(), Kind: o.GetKind()}
+		if !seen[k] {
+			seen[k] = true
+			kinds = append(kinds, k)
+		}
+	}
+	return kinds
+}
+
+func (in *Instancer) CreateInstance(ctx context.Context, challenge, team string) (db.InstanceRecord, error) {
 	log := in.log.With().Str("component", "instanced").Logger()
 
-	/* chal, ok := in.challengeObjs[challenge]
+	reg, ok := in.challenges.Get(challenge)
 	if !ok {
-		return InstanceRecord{}, &ChallengeNotFoundError{challenge}
-	} */
+		return db.InstanceRecord{}, &ChallengeNotFoundError{challenge}
+	}
+	def := reg.ChallengeDefinition
 	cuuid := uuid.NewString()[0:8]
-	chal, err := in.GetChalObjsFromTemplate(challenge, cuuid)
+	namespace := in.conf.Namespace
+	if in.conf.IsolateNamespaces {
+		namespace = in.instanceNamespaceName(challenge, cuuid)
+	}
+	id := k8s.ChalInstIdentifier{ID: cuuid, Challenge: challenge, Namespace: namespace}
+	chal, err := renderChallengeObjs(def, id)
 	if err != nil {
 		return db.InstanceRecord{}, err
 	}
 
-	ttl, err := time.ParseDuration(in.conf.InstanceTTL)
+	endpoints, err := renderEndpoints(def.Name, in.challengeEndpoints(def), id)
 	if err != nil {
-		log.Warn().Err(err).Msg("could not parse instance ttl, defaulting to 10 minutes")
-		ttl = 10 * time.Minute
+		return db.InstanceRecord{}, err
 	}
 
-	rec, err := in.dbC.InsertInstanceRecord(ttl, team, challenge, cuuid)
+	ttl := in.challengeTTL(def)
+
+	rec, err := in.dbC.InsertInstanceRecord(ctx, ttl, db.InstanceRecord{
+		Challenge: challenge,
+		TeamID:    team,
+		UUID:      cuuid,
+		Endpoints: endpoints,
+		Namespace: namespace,
+		Isolated:  in.conf.IsolateNamespaces,
+		Kinds:     objectKinds(chal),
+	}, db.Quotas{
+		Team:      in.conf.TeamQuota,
+		Challenge: def.MaxInstances,
+		Cluster:   in.conf.ClusterQuota,
+	})
+	var quotaErr *db.QuotaExceededError
+	if errors.As(err, &quotaErr) {
+		log.Info().Err(err).Str("challenge", challenge).Str("team", team).Msg("instance quota reached")
+		return db.InstanceRecord{}, err
+	}
+	var dupErr *db.DuplicateInstanceError
+	if errors.As(err, &dupErr) {
+		return db.InstanceRecord{}, err
+	}
 	if err != nil {
 		log.Error().Err(err).Msg("could not create instance record")
-	} else {
-		log.Info().Time("expiry", rec.Expiry).
-			Str("challenge", rec.Challenge).
-			Int64("id", rec.Id).
-			Msg("registered new instance")
+		return db.InstanceRecord{}, err
+	}
+	log.Info().Time("expiry", rec.Expiry).
+		Str("challenge", rec.Challenge).
+		Str("namespace", rec.Namespace).
+		Int64("id", rec.Id).
+		Msg("registered new instance")
+
+	objs := templateObjs(chal, rec)
+	queued := in.jobs.enqueue(instanceKey(rec.Id), JobDeploy, func(ctx context.Context) error {
+		in.deployInstance(ctx, rec, objs)
+		return nil
+	})
+	if !queued {
+		// Nothing was created, the record must not count against quotas as provisioning
+		in.finishDeploy(ctx, rec, db.StateFailed, ErrQueueClosed)
+		return db.InstanceRecord{}, ErrQueueClosed
 	}
+	return rec, nil
+}
 
-	var createErr error
-	log.Info().Int("count", len(chal)).Msg("creating objects")
+// templateObjs prepares the rendered challenge objects of an instance for creation.
+func templateObjs(chal []unstructured.Unstructured, rec db.InstanceRecord) []*unstructured.Unstructured {
+	objs := make([]*unstructured.Unstructured, 0, len(chal))
 	for _, o := range chal {
 		obj := o.DeepCopy()
-		//obj.SetName(fmt.Sprintf("in-%v-%v", obj.GetName(), rec.Id))
-		var resObj *unstructured.Unstructured
-		resObj, createErr = in.k8sC.CreateObject(obj, "challenges")
-		log.Debug().Any("object", resObj).Msg("created object")
-		if createErr != nil {
-			log.Error().Err(createErr).Msg("error creating object")
-			break
-		}
-		log.Info().Str("kind", resObj.GetKind()).Str("name", resObj.GetName()).Msg("created object")
-	}
-	if createErr != nil {
-		// todo: handle errors/cleanup incomplete deploys?
-		log.Error().Err(err).Msg("could not create an object")
-		log.Info().Msg("instance creation incomplete, manual intervention required")
-		return db.InstanceRecord{}, errors.New("instance deployment failed")
+		// Templates may hard-code a namespace, objects must be created in the instance namespace
+		obj.SetNamespace(rec.Namespace)
+		setInstanceLabels(obj, rec)
+		objs = append(objs, obj)
 	}
+	return objs
+}
+
+// deployInstance creates the challenge objects of an instance, preceded by its namespace objects if it is isolated,
+// and starts waiting for it to become ready outside the workers, moving the instance to the ready or failed state.
+// A failed or cancelled deploy is rolled back, except for the namespace objects which a restart deploys into again.
+func (in *Instancer) deployInstance(ctx context.Context, rec db.InstanceRecord, objs []*unstructured.Unstructured) {
+	log := in.log.With().Str("component", "instanced").Int64("id", rec.Id).Logger()
+
+	kept := 0
+	if rec.Isolated {
+		nsObjs := in.instanceNamespaceObjs(rec)
+		kept = len(nsObjs)
+		objs = append(nsObjs, objs...)
+	}
+	log.Info().Int("count", len(objs)).Msg("creating objects")
+	created := make([]*unstructured.Unstructured, 0, len(objs))
+	for i, obj := range objs {
+		attempted := false
+		err := ctx.Err()
+		if err == nil {
+			err = in.retryTransient(ctx, "create", func() error {
+				resObj, err := in.k8sC.CreateObject(ctx, obj, obj.GetNamespace())
+				// A retried create may find the object created by an attempt which timed out,
+				// and a restart finds the namespace objects left by the previous deploy
+				if (attempted || i < kept) && apierrors.IsAlreadyExists(err) {
+					return nil
+				}
+				attempted = true
+				if err == nil {
+					log.Debug().Any("object", resObj).Msg("created object")
+				}
+				return err
+			})
+		}
+		if err != nil {
+			log.Error().Err(err).Str("kind", obj.GetKind()).Str("name", obj.GetName()).Msg("error creating object")
+			deployErr := &InstanceDeployError{
+				Challenge: rec.Challenge,
+				Object:    ObjectRef{Kind: obj.GetKind(), Name: obj.GetName()},
+				Err:       err,
+			}
+			deployErr.RollbackErrs = in.rollbackInstance(ctx, rec, created)
+			if len(deployErr.RollbackErrs) > 0 {
+				in.failDeploy(ctx, rec, deployErr)
+				return
+			}
+			in.finishDeploy(ctx, rec, db.StateFailed, deployErr)
+			return
+		}
+		log.Info().Str("kind", obj.GetKind()).Str("name", obj.GetName()).Msg("created object")
+		if i >= kept {
+			created = append(created, obj)
+		}
+	}
+
+	// Instances may take minutes to become ready, which must not hold up destroying other instances
+	in.jobs.detach(instanceKey(rec.Id), JobReady, func(ctx context.Context) error {
+		in.awaitReady(ctx, rec)
+		return nil
+	})
+}
+
+// awaitReady waits for a deployed instance to become ready within the ready timeout and records the outcome.
+func (in *Instancer) awaitReady(ctx context.Context, rec db.InstanceRecord) {
+	log := in.log.With().Str("component", "instanced").Int64("id", rec.Id).Logger()
+
+	readyCtx, cancel := context.WithTimeout(ctx, in.conf.ReadyTimeout)
+	defer cancel()
+	err := in.k8sC.WaitForInstanceReady(readyCtx, rec.Namespace, instanceSelector(rec))
+	if err != nil {
+		log.Error().Err(err).Msg("instance did not become ready")
+		in.failDeploy(ctx, rec, fmt.Errorf("instance did not become ready: %w", err))
+		return
+	}
+	in.finishDeploy(ctx, rec, db.StateReady, nil)
+	log.Info().Msg("instance ready")
+}
+
+// finishDeploy moves a provisioning instance to its final state, even if the deploy was cancelled.
+// Instances destroyed while they were being deployed are left as they are.
+func (in *Instancer) finishDeploy(ctx context.Context, rec db.InstanceRecord, to db.InstanceState, reason error) {
+	ctx, cancel := cleanupContext(ctx)
+	defer cancel()
+	_, err := in.transitionInstance(ctx, rec, to, reason)
+	if errors.Is(err, db.ErrStateConflict) {
+		in.log.Info().Str("component", "instanced").Int64("id", rec.Id).Msg("instance changed state while deploying")
+		return
+	}
+	if err != nil {
+		in.log.Error().Err(err).Str("component", "instanced").Int64("id", rec.Id).Msg("error updating instance state")
+	}
+}
+
+// failDeploy deletes the challenge objects left by a failed deploy of an instance and records the failure.
+// The namespace of an isolated instance is kept, so the instance can still be restarted.
+// Failed instances count neither as duplicates nor towards the quotas, so if any object could not be deleted
+// the instance is left terminating instead, holding its slot until it is destroyed on expiry or by request.
+func (in *Instancer) failDeploy(ctx context.Context, rec db.InstanceRecord, reason error) {
+	ctx, cancel := cleanupContext(ctx)
+	defer cancel()
+	errs := in.deleteObjsByLabel(ctx, rec)
+	if len(errs) > 0 {
+		in.log.Warn().Str("component", "instanced").Int64("id", rec.Id).Msg("objects of failed instance remain, leaving it terminating")
+		in.finishDeploy(ctx, rec, db.StateTerminating, errors.Join(append([]error{reason}, errs...)...))
+		return
+	}
+	in.finishDeploy(ctx, rec, db.StateFailed, reason)
+}
+
+// rollbackInstance deletes the objects of a partially created instance in reverse order of creation.
+// Errors are collected and returned rather than aborting the rollback, which also runs for cancelled deploys.
+func (in *Instancer) rollbackInstance(ctx context.Context, rec db.InstanceRecord, created []*unstructured.Unstructured) []error {
+	ctx, cancel := cleanupContext(ctx)
+	defer cancel()
+	log := in.log.With().Str("component", "instanced").Logger()
+	log.Info().Int64("id", rec.Id).Int("count", len(created)).Msg("rolling back incomplete instance")
+
+	var errs []error
+	for i := len(created) - 1; i >= 0; i-- {
+		obj := created[i]
+		err := in.retryTransient(ctx, "delete", func() error {
+			return in.k8sC.DeleteObject(ctx, obj, obj.GetNamespace())
+		})
+		if err != nil {
+			log.Error().Err(err).Str("kind", obj.GetKind()).Str("name", obj.GetName()).Msg("error rolling back object")
+			errs = append(errs, fmt.Errorf("delete %v %q: %w", obj.GetKind(), obj.GetName(), err))
+		}
+	}
+	if len(errs) > 0 {
+		log.Warn().Int64("id", rec.Id).Msg("instance rollback incomplete, manual intervention required")
+	}
+	return errs
+}
+
+// instanceDeadline returns the end of the maximum lifetime of an instance, measured from its creation.
+func (in *Instancer) instanceDeadline(rec db.InstanceRecord, def k8s.ChallengeDefinition) time.Time {
+	created := rec.Created
+	if created.Unix() == 0 {
+		// Records from before creation times were stored, assume the default ttl was used
+		created = rec.Expiry.Add(-in.challengeTTL(def))
+	}
+	return created.Add(in.challengeMaxTTL(def))
+}
+
+// ExtendInstance pushes the expiry of an instance forward by the configured extend step.
+// The new expiry is capped by the maximum lifetime of the challenge, measured from the creation of the instance.
+func (in *Instancer) ExtendInstance(ctx context.Context, id int64) (db.InstanceRecord, error) {
+	log := in.log.With().Str("component", "instanced").Logger()
+	rec, err := in.dbC.ReadInstanceRecord(ctx, id)
+	if err != nil {
+		return db.InstanceRecord{}, err
+	}
+
+	if rec.State != db.StateProvisioning && rec.State != db.StateReady {
+		return db.InstanceRecord{}, &InstanceExtendError{id, fmt.Sprintf("instance is %v", rec.State)}
+	}
+	now := time.Now()
+	if now.After(rec.Expiry) {
+		return db.InstanceRecord{}, &InstanceExtendError{id, "instance has expired"}
+	}
+	if rec.Extensions >= in.conf.MaxExtensions {
+		return db.InstanceRecord{}, &InstanceExtendError{id, "maximum number of extensions reached"}
+	}
+
+	// Challenges which are no longer loaded fall back to the global limits
+	reg, _ := in.challenges.Get(rec.Challenge)
+	deadline := in.instanceDeadline(rec, reg.ChallengeDefinition)
+	expiry := rec.Expiry.Add(in.conf.ExtendStep)
+	if expiry.After(deadline) {
+		expiry = deadline
+	}
+	if !expiry.After(rec.Expiry) {
+		return db.InstanceRecord{}, &InstanceExtendError{id, "maximum lifetime reached"}
+	}
+
+	rec, err = in.dbC.ExtendInstanceRecord(ctx, id, expiry, in.conf.MaxExtensions)
+	if errors.Is(err, db.ErrExtensionLimit) {
+		return db.InstanceRecord{}, &InstanceExtendError{id, "maximum number of extensions reached"}
+	}
+	if errors.Is(err, db.ErrStateConflict) {
+		return db.InstanceRecord{}, &InstanceExtendError{id, "instance changed state concurrently"}
+	}
+	if err != nil {
+		return db.InstanceRecord{}, err
+	}
+	log.Info().Int64("id", rec.Id).
+		Str("challenge", rec.Challenge).
+		Time("expiry", rec.Expiry).
+		Int("extensions", rec.Extensions).
+		Msg("extended instance")
 	return rec, nil
 }
 
-func (in *Instancer) GetTeamChallengeStates(teamID string) ([]db.InstanceRecord, error) {
-	instances, err := in.dbC.ReadInstanceRecordsTeam(teamID)
+// RestartInstance tears down and redeploys the challenge objects of an instance, keeping its id, identifier and endpoints.
+// If resetExpiry is set the instance is given a fresh lifetime, capped by the maximum lifetime of the challenge.
+func (in *Instancer) RestartInstance(ctx context.Context, id int64, resetExpiry bool) (db.InstanceRecord, error) {
+	log := in.log.With().Str("component", "instanced").Int64("id", id).Logger()
+	rec, err := in.dbC.ReadInstanceRecord(ctx, id)
+	if err != nil {
+		return db.InstanceRecord{}, err
+	}
+
+	if !validTransition(rec.State, db.StateProvisioning) {
+		return db.InstanceRecord{}, &InstanceRestartError{id, fmt.Sprintf("instance is %v", rec.State)}
+	}
+	now := time.Now()
+	if now.After(rec.Expiry) {
+		return db.InstanceRecord{}, &InstanceRestartError{id, "instance has expired"}
+	}
+	if len(rec.Kinds) == 0 {
+		return db.InstanceRecord{}, &InstanceRestartError{id, "instance predates object labels, recreate it instead"}
+	}
+	reg, ok := in.challenges.Get(rec.Challenge)
+	if !ok {
+		return db.InstanceRecord{}, &ChallengeNotFoundError{rec.Challenge}
+	}
+	def := reg.ChallengeDefinition
+	chal, err := renderChallengeObjs(def, k8s.ChalInstIdentifier{ID: rec.UUID, Challenge: rec.Challenge, Namespace: rec.Namespace})
+	if err != nil {
+		return db.InstanceRecord{}, err
+	}
+
+	expiry := rec.Expiry
+	if resetExpiry {
+		expiry = now.Add(in.challengeTTL(def))
+		if deadline := in.instanceDeadline(rec, def); expiry.After(deadline) {
+			expiry = deadline
+		}
+		// Restarting never shortens the lifetime of an instance
+		if expiry.Before(rec.Expiry) {
+			expiry = rec.Expiry
+		}
+	}
+
+	// Failed instances do not hold a slot, so the store checks the team has not created the challenge again since
+	restarted, err := in.dbC.RestartInstanceRecord(ctx, id, rec.State, expiry, objectKinds(chal), db.Quotas{
+		Team:      in.conf.TeamQuota,
+		Challenge: def.MaxInstances,
+		Cluster:   in.conf.ClusterQuota,
+	})
+	if errors.Is(err, db.ErrStateConflict) {
+		return db.InstanceRecord{}, &InstanceRestartError{id, "instance changed state concurrently"}
+	}
+	var dupErr *db.DuplicateInstanceError
+	if errors.As(err, &dupErr) {
+		return db.InstanceRecord{}, &InstanceRestartError{id, fmt.Sprintf("team has another instance %v of the challenge", dupErr.Existing.Id)}
+	}
+	var quotaErr *db.QuotaExceededError
+	if errors.As(err, &quotaErr) {
+		return db.InstanceRecord{}, &InstanceRestartError{id, quotaErr.Error()}
+	}
+	if err != nil {
+		return db.InstanceRecord{}, err
+	}
+	log.Info().Str("challenge", rec.Challenge).
+		Time("expiry", restarted.Expiry).
+		Msg("restarting instance")
+
+	objs := templateObjs(chal, restarted)
+	queued := in.jobs.enqueue(instanceKey(id), JobRestart, func(ctx context.Context) error {
+		in.redeployInstance(ctx, restarted, rec.Kinds, objs)
+		return nil
+	})
+	if !queued {
+		// The objects deployed before the restart are still running
+		failed := restarted
+		failed.Kinds = mergeKinds(rec.Kinds, restarted.Kinds)
+		in.failDeploy(ctx, failed, ErrQueueClosed)
+		return db.InstanceRecord{}, ErrQueueClosed
+	}
+	return restarted, nil
+}
+
+// redeployInstance deletes the challenge objects of a restarting instance, waits for them to disappear and deploys objs.
+// Objects of the previous kinds are deleted as well, in case the challenge template changed.
+func (in *Instancer) redeployInstance(ctx context.Context, rec db.InstanceRecord, previous []db.ObjectKind, objs []*unstructured.Unstructured) {
+	log := in.log.With().Str("component", "instanced").Int64("id", rec.Id).Logger()
+
+	kinds := mergeKinds(previous, rec.Kinds)
+
+	// A failed restart must also remove objects of the previous kinds
+	failed := rec
+	failed.Kinds = kinds
+
+	deleteCtx, cancel := context.WithTimeout(ctx, in.conf.ReadyTimeout)
+	defer cancel()
+	selector := instanceSelector(rec)
+	for _, k := range kinds {
+		gvk := schema.FromAPIVersionAndKind(k.APIVersion, k.Kind)
+		var n int
+		err := in.retryTransient(ctx, "delete", func() (err error) {
+			n, err = in.k8sC.DeleteObjectsByLabel(ctx, gvk, rec.Namespace, selector)
+			return err
+		})
+		if err != nil {
+			log.Error().Err(err).Str("kind", k.Kind).Msg("error deleting objects for restart")
+			in.failDeploy(ctx, failed, fmt.Errorf("could not delete objects for restart: %w", err))
+			return
+		}
+		log.Debug().Int("count", n).Str("kind", k.Kind).Msg("deleted objects")
+	}
+	for _, k := range kinds {
+		gvk := schema.FromAPIVersionAndKind(k.APIVersion, k.Kind)
+		err := in.k8sC.WaitForObjectsDeleted(deleteCtx, gvk, rec.Namespace, selector)
+		if err != nil {
+			log.Error().Err(err).Str("kind", k.Kind).Msg("objects were not deleted for restart")
+			in.failDeploy(ctx, failed, fmt.Errorf("objects were not deleted for restart: %w", err))
+			return
+		}
+	}
+
+	in.deployInstance(ctx, rec, objs)
+}
+
+// mergeKinds returns the distinct kinds of a followed by those of b which are not in a.
+func mergeKinds(a []db.ObjectKind, b []db.ObjectKind) []db.ObjectKind {
+	kinds := append([]db.ObjectKind{}, a...)
+	for _, k := range b {
+		if !slices.Contains(kinds, k) {
+			kinds = append(kinds, k)
+		}
+	}
+	return kinds
+}
+
+// GetTeamChallengeStates returns the instance shown to a team for each of its challenges, with a placeholder record
+// for every loaded challenge the team has no instance of.
+func (in *Instancer) GetTeamChallengeStates(ctx context.Context, teamID string) ([]db.InstanceRecord, error) {
+	records, err := in.dbC.ReadInstanceRecordsTeam(ctx, teamID)
 	if err != nil {
 		return nil, err
 	}
-	//for k := range in.challengeObjs {
-	for k := range in.challengeTmpls {
-		active := false
-		for _, v := range instances {
-			if v.Challenge == k {
-				active = true
-				break
-			}
+	instances := make([]db.InstanceRecord, 0, len(records))
+	for _, r := range records {
+		// Failed attempts superseded by a later instance of the challenge are left out
+		if shown, _ := teamChallengeInstance(records, r.Challenge); shown.Id == r.Id {
+			instances = append(instances, r)
 		}
-		if !active {
-			instances = append(instances, db.InstanceRecord{Expiry: time.Unix(0, 0), Challenge: k, TeamID: teamID})
+	}
+	for _, c := range in.challenges.List() {
+		if _, ok := teamChallengeInstance(records, c.Name); !ok {
+			instances = append(instances, db.InstanceRecord{Expiry: time.Unix(0, 0), Challenge: c.Name, TeamID: teamID})
 		}
 	}
 	return instances, nil
 }
 
-type ChalInstIdentifier struct {
-	ID string
+// teamChallengeInstance returns the instance of a challenge shown to a team among its records.
+// Failed instances do not hold a slot, so an active instance is preferred over them
+// and the latest failed instance is only returned if there is no active one.
+func teamChallengeInstance(records []db.InstanceRecord, challenge string) (db.InstanceRecord, bool) {
+	var res db.InstanceRecord
+	found := false
+	for _, r := range records {
+		if r.Challenge != challenge {
+			continue
+		}
+		if found {
+			resFailed, rFailed := res.State == db.StateFailed, r.State == db.StateFailed
+			if rFailed && !resFailed || rFailed == resFailed && r.Id < res.Id {
+				continue
+			}
+		}
+		res = r
+		found = true
+	}
+	return res, found
 }
 
-func (in *Instancer) GetChalObjsFromTemplate(chalName string, cuuid string) ([]unstructured.Unstructured, error) {
-	tmpl, ok := in.challengeTmpls[chalName]
+// challengeEndpoints returns the endpoint templates of a challenge,
+// falling back to the global endpoint template when the challenge does not declare any.
+func (in *Instancer) challengeEndpoints(def k8s.ChallengeDefinition) []k8s.EndpointTemplate {
+	if len(def.Endpoints) > 0 || in.conf.EndpointTemplate.Template == nil {
+		return def.Endpoints
+	}
+	return []k8s.EndpointTemplate{in.conf.EndpointTemplate}
+}
+
+// renderEndpoints renders the endpoint templates of a challenge for an instance.
+func renderEndpoints(challenge string, endpoints []k8s.EndpointTemplate, id k8s.ChalInstIdentifier) ([]db.Endpoint, error) {
+	res := make([]db.Endpoint, 0, len(endpoints))
+	for _, e := range endpoints {
+		var url bytes.Buffer
+		err := e.Template.Execute(&url, id)
+		if err != nil {
+			return nil, fmt.Errorf("could not render endpoint %q of challenge %q: %w", e.Name, challenge, err)
+		}
+		res = append(res, db.Endpoint{Name: e.Name, URL: url.String()})
+	}
+	return res, nil
+}
+
+func (in *Instancer) GetChalObjsFromTemplate(chalName string, id k8s.ChalInstIdentifier) ([]unstructured.Unstructured, error) {
+	reg, ok := in.challenges.Get(chalName)
 	if !ok {
 		return nil, &ChallengeNotFoundError{chalName}
 	}
+	return renderChallengeObjs(reg.ChallengeDefinition, id)
+}
+
+// renderChallengeObjs renders the challenge template of a challenge for an instance.
+func renderChallengeObjs(def k8s.ChallengeDefinition, id k8s.ChalInstIdentifier) ([]unstructured.Unstructured, error) {
 	var objstr bytes.Buffer
-	tmpl.Execute(&objstr, ChalInstIdentifier{ID: cuuid})
+	err := def.Template.Execute(&objstr, id)
+	if err != nil {
+		return nil, fmt.Errorf("could not render challenge: %q : %w", def.Name, err)
+	}
 	chal, err := k8s.UnmarshalManifestFile(objstr.String())
 	if err != nil {
-		return nil, fmt.Errorf("could not parse challenge: %q : %w", chalName, err)
+		return nil, fmt.Errorf("could not parse challenge: %q : %w", def.Name, err)
 	}
 	return chal, nil
 }
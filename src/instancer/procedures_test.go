@@ -0,0 +1,167 @@
+package instancer
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"text/template"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog"
+	"github.com/ubcctf/instanced/src/db"
+	"github.com/ubcctf/instanced/src/k8s"
+)
+
+// newTestStoreInstancer returns an Instancer backed by a fresh SQLite store with challenges loaded.
+func newTestStoreInstancer(t *testing.T, challenges ...string) *Instancer {
+	store, err := db.NewSQLiteStore(context.Background(), filepath.Join(t.TempDir(), "instances.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	defs := make(map[string]k8s.ChallengeDefinition)
+	for _, c := range challenges {
+		defs[c] = k8s.ChallengeDefinition{Name: c}
+	}
+	in := &Instancer{dbC: store, challenges: NewChallengeRegistry(), log: zerolog.Nop()}
+	in.challenges.Replace(defs, nil)
+	return in
+}
+
+// insertTestInstance stores an instance of a challenge for a team and moves it to state to.
+func insertTestInstance(t *testing.T, store db.InstanceStore, challenge, team string, to db.InstanceState) db.InstanceRecord {
+	t.Helper()
+	ctx := context.Background()
+	rec, err := store.InsertInstanceRecord(ctx, time.Hour, db.InstanceRecord{Challenge: challenge, TeamID: team}, db.Quotas{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if to != db.StateProvisioning {
+		rec, err = store.UpdateInstanceState(ctx, rec.Id, db.StateProvisioning, to, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return rec
+}
+
+func TestTeamChallengeStatesPreferActiveInstance(t *testing.T) {
+	in := newTestStoreInstancer(t, "chal", "broken", "unused")
+	insertTestInstance(t, in.dbC, "chal", "team", db.StateFailed)
+	ready := insertTestInstance(t, in.dbC, "chal", "team", db.StateReady)
+	insertTestInstance(t, in.dbC, "broken", "team", db.StateFailed)
+	failed := insertTestInstance(t, in.dbC, "broken", "team", db.StateFailed)
+
+	want := map[string]int64{"chal": ready.Id, "broken": failed.Id, "unused": 0}
+
+	states, err := in.GetTeamChallengeStates(context.Background(), "team")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string]int64)
+	for _, s := range states {
+		if _, ok := got[s.Challenge]; ok {
+			t.Errorf("challenge %q listed more than once", s.Challenge)
+		}
+		got[s.Challenge] = s.Id
+	}
+	for chal, id := range want {
+		if got[chal] != id {
+			t.Errorf("GetTeamChallengeStates shows instance %v of %q, want %v", got[chal], chal, id)
+		}
+	}
+
+	e := echo.New()
+	resp := httptest.NewRecorder()
+	c := e.NewContext(httptest.NewRequest(http.MethodGet, "/api/v1/teams/team/challenges", nil), resp)
+	c.SetParamNames("team")
+	c.SetParamValues("team")
+	if err := in.handleV1TeamChallengeList(c); err != nil {
+		t.Fatal(err)
+	}
+	var res []TeamChallengeResponse
+	if err := json.Unmarshal(resp.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range res {
+		var id int64
+		if r.Instance != nil {
+			id = r.Instance.ID
+		}
+		if id != want[r.Challenge] {
+			t.Errorf("/api/v1 shows instance %v of %q, want %v", id, r.Challenge, want[r.Challenge])
+		}
+	}
+}
+
+// waitForState fails the test if the instance does not reach state to in time.
+func waitForState(t *testing.T, store db.InstanceStore, id int64, to db.InstanceState) db.InstanceRecord {
+	t.Helper()
+	for deadline := time.Now().Add(testWait); ; {
+		rec, err := store.ReadInstanceRecord(context.Background(), id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rec.State == to {
+			return rec
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("instance %v is %v, want %v: %v", id, rec.State, to, rec.Error)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+const restartTemplate = `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: config
+---
+apiVersion: v1
+kind: Service
+metadata:
+  name: broken
+`
+
+// TestRestartAfterFailedIsolatedDeploy checks that the rollback of a failed deploy keeps the namespace of an
+// isolated instance, so the instance can be restarted into it.
+func TestRestartAfterFailedIsolatedDeploy(t *testing.T) {
+	in := newTestStoreInstancer(t)
+	apiserver, client := newFakeAPIServer(t)
+	in.k8sC = client
+	in.jobs = newTestQueue(t, 1)
+	in.conf = loadConfig(zerolog.Nop())
+	in.conf.IsolateNamespaces = true
+	in.conf.JobRetries = 0
+	in.challenges.Replace(map[string]k8s.ChallengeDefinition{
+		"chal": {Name: "chal", Template: template.Must(template.New("chal").Parse(restartTemplate))},
+	}, nil)
+
+	apiserver.setFail("broken", true)
+	rec, err := in.CreateInstance(context.Background(), "chal", "team")
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForState(t, in.dbC, rec.Id, db.StateFailed)
+	if apiserver.get("namespaces", "", rec.Namespace) == nil {
+		t.Fatal("rollback deleted the instance namespace")
+	}
+	if apiserver.get("configmaps", rec.Namespace, "config") != nil {
+		t.Fatal("rollback kept the challenge objects")
+	}
+
+	apiserver.setFail("broken", false)
+	if _, err := in.RestartInstance(context.Background(), rec.Id, false); err != nil {
+		t.Fatal(err)
+	}
+	waitForState(t, in.dbC, rec.Id, db.StateReady)
+	for _, res := range []string{"configmaps", "services"} {
+		if n := apiserver.count(res, rec.Namespace); n != 1 {
+			t.Errorf("restarted instance has %v %v, want 1", n, res)
+		}
+	}
+}
@@ -0,0 +1,284 @@
+package instancer
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/ubcctf/instanced/src/db"
+)
+
+const (
+	// PurgeRunning is the state of a purge job which is destroying instances.
+	PurgeRunning = "running"
+	// PurgeCompleted is the state of a purge job which has attempted to destroy every matched instance.
+	PurgeCompleted = "completed"
+
+	// maxPurgeJobs is the number of finished purge jobs kept for querying
+	maxPurgeJobs = 20
+)
+
+// ErrPurgeRunning is returned when starting a purge while another is running.
+var ErrPurgeRunning = errors.New("a purge is already running")
+
+// PurgeFilter selects the instances destroyed by a purge. Empty fields match every instance.
+type PurgeFilter struct {
+	Challenge string `json:"challenge,omitempty"`
+	Team      string `json:"team,omitempty"`
+	// OlderThan matches instances created at least this long before the purge started
+	OlderThan time.Duration `json:"-"`
+}
+
+// MarshalJSON formats OlderThan as a duration string such as "2h0m0s".
+func (f PurgeFilter) MarshalJSON() ([]byte, error) {
+	type filter PurgeFilter
+	var olderThan string
+	if f.OlderThan > 0 {
+		olderThan = f.OlderThan.String()
+	}
+	return json.Marshal(struct {
+		filter
+		OlderThan string `json:"older_than,omitempty"`
+	}{filter(f), olderThan})
+}
+
+func (f PurgeFilter) matches(rec db.InstanceRecord, now time.Time) bool {
+	if f.Challenge != "" && rec.Challenge != f.Challenge {
+		return false
+	}
+	if f.Team != "" && rec.TeamID != f.Team {
+		return false
+	}
+	return f.OlderThan <= 0 || now.Sub(rec.Created) >= f.OlderThan
+}
+
+// PurgeRequest is the body of a request to purge instances.
+type PurgeRequest struct {
+	// Confirm must be set to destroy instances. It is not required for a dry run.
+	Confirm   bool   `json:"confirm"`
+	DryRun    bool   `json:"dry_run"`
+	Challenge string `json:"challenge"`
+	Team      string `json:"team"`
+	// OlderThan is a duration such as "2h"
+	OlderThan string `json:"older_than"`
+}
+
+// PurgeFailure is an instance which a purge job could not destroy.
+type PurgeFailure struct {
+	ID    int64  `json:"id"`
+	Error string `json:"error"`
+}
+
+// PurgeJob tracks the progress of a purge.
+type PurgeJob struct {
+	ID         int64          `json:"id"`
+	State      string         `json:"state"`
+	Filter     PurgeFilter    `json:"filter"`
+	Total      int            `json:"total"`
+	Destroyed  int            `json:"destroyed"`
+	Failures   []PurgeFailure `json:"failures"`
+	StartedAt  time.Time      `json:"started_at"`
+	FinishedAt *time.Time     `json:"finished_at"`
+}
+
+// PurgePreviewResponse lists the instances a purge would destroy.
+type PurgePreviewResponse struct {
+	DryRun    bool               `json:"dry_run"`
+	Instances []InstanceResponse `json:"instances"`
+}
+
+// purgeTracker holds the running purge job and the most recent finished ones.
+type purgeTracker struct {
+	mu     sync.Mutex
+	nextID int64
+	jobs   []*PurgeJob
+}
+
+func newPurgeTracker() *purgeTracker {
+	return &purgeTracker{nextID: 1}
+}
+
+// start records a new running job, failing if another job is running.
+func (t *purgeTracker) start(filter PurgeFilter, total int) (*PurgeJob, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, j := range t.jobs {
+		if j.State == PurgeRunning {
+			return nil, ErrPurgeRunning
+		}
+	}
+	job := &PurgeJob{
+		ID:        t.nextID,
+		State:     PurgeRunning,
+		Filter:    filter,
+		Total:     total,
+		Failures:  []PurgeFailure{},
+		StartedAt: time.Now(),
+	}
+	t.nextID++
+	t.jobs = append(t.jobs, job)
+	if len(t.jobs) > maxPurgeJobs {
+		t.jobs = t.jobs[len(t.jobs)-maxPurgeJobs:]
+	}
+	return job, nil
+}
+
+// update applies fn to a job while holding the lock.
+func (t *purgeTracker) update(job *PurgeJob, fn func(j *PurgeJob)) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	fn(job)
+}
+
+// get returns a copy of the job with the given id.
+func (t *purgeTracker) get(id int64) (PurgeJob, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, j := range t.jobs {
+		if j.ID == id {
+			return j.copy(), true
+		}
+	}
+	return PurgeJob{}, false
+}
+
+// list returns copies of the tracked jobs, most recent first.
+func (t *purgeTracker) list() []PurgeJob {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	res := make([]PurgeJob, 0, len(t.jobs))
+	for i := len(t.jobs) - 1; i >= 0; i-- {
+		res = append(res, t.jobs[i].copy())
+	}
+	return res
+}
+
+// finish marks a job completed.
+func (j *PurgeJob) finish() {
+	now := time.Now()
+	j.State = PurgeCompleted
+	j.FinishedAt = &now
+}
+
+func (j *PurgeJob) copy() PurgeJob {
+	c := *j
+	c.Failures = append([]PurgeFailure{}, j.Failures...)
+	return c
+}
+
+// PurgeInstances queues the destruction of every active instance matching filter.
+// The returned job is updated as instances are destroyed.
+func (in *Instancer) PurgeInstances(ctx context.Context, filter PurgeFilter) (PurgeJob, error) {
+	recs, err := in.purgeCandidates(ctx, filter)
+	if err != nil {
+		return PurgeJob{}, err
+	}
+	job, err := in.purgeJobs.start(filter, len(recs))
+	if err != nil {
+		return PurgeJob{}, err
+	}
+	log := in.log.With().Str("component", "instanced").Int64("purge", job.ID).Logger()
+	log.Info().Int("count", len(recs)).Msg("purge started")
+
+	if len(recs) == 0 {
+		in.purgeJobs.update(job, func(j *PurgeJob) { j.finish() })
+	}
+	started := job.copy()
+	for _, r := range recs {
+		id := r.Id
+		in.enqueueDestroy(id, func(err error) {
+			if err != nil {
+				log.Warn().Err(err).Int64("id", id).Msg("an instance failed to purge")
+			}
+			in.purgeJobs.update(job, func(j *PurgeJob) {
+				if err != nil {
+					j.Failures = append(j.Failures, PurgeFailure{id, err.Error()})
+				} else {
+					j.Destroyed++
+				}
+				if j.Destroyed+len(j.Failures) == j.Total {
+					j.finish()
+					log.Info().Int("destroyed", j.Destroyed).Int("failed", len(j.Failures)).Msg("purge completed")
+				}
+			})
+		})
+	}
+	return started, nil
+}
+
+// purgeCandidates returns the active instances matching filter.
+func (in *Instancer) purgeCandidates(ctx context.Context, filter PurgeFilter) ([]db.InstanceRecord, error) {
+	recs, err := in.dbC.ReadInstanceRecords(ctx)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	matched := make([]db.InstanceRecord, 0, len(recs))
+	for _, r := range recs {
+		if filter.matches(r, now) {
+			matched = append(matched, r)
+		}
+	}
+	return matched, nil
+}
+
+func (in *Instancer) handleV1Purge(c echo.Context) error {
+	var req PurgeRequest
+	if err := c.Bind(&req); err != nil {
+		return apiError(c, http.StatusBadRequest, CodeInvalidRequest, "invalid request body", nil)
+	}
+	filter := PurgeFilter{Challenge: req.Challenge, Team: req.Team}
+	if req.OlderThan != "" {
+		d, err := time.ParseDuration(req.OlderThan)
+		if err != nil || d < 0 {
+			return apiError(c, http.StatusBadRequest, CodeInvalidRequest, "invalid older_than duration", nil)
+		}
+		filter.OlderThan = d
+	}
+
+	if req.DryRun {
+		recs, err := in.purgeCandidates(c.Request().Context(), filter)
+		if err != nil {
+			return internalError(c, err)
+		}
+		res := PurgePreviewResponse{DryRun: true, Instances: make([]InstanceResponse, 0, len(recs))}
+		for _, r := range recs {
+			res.Instances = append(res.Instances, newInstanceResponse(r))
+		}
+		return c.JSON(http.StatusOK, res)
+	}
+	if !req.Confirm {
+		return apiError(c, http.StatusBadRequest, CodeInvalidRequest, "purge requires \"confirm\": true", nil)
+	}
+
+	job, err := in.PurgeInstances(c.Request().Context(), filter)
+	if errors.Is(err, ErrPurgeRunning) {
+		return apiError(c, http.StatusConflict, CodeConflict, err.Error(), nil)
+	}
+	if err != nil {
+		return internalError(c, err)
+	}
+	c.Logger().Info("processed request to purge instances")
+	return c.JSON(http.StatusAccepted, job)
+}
+
+func (in *Instancer) handleV1PurgeList(c echo.Context) error {
+	return c.JSON(http.StatusOK, in.purgeJobs.list())
+}
+
+func (in *Instancer) handleV1PurgeGet(c echo.Context) error {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return apiError(c, http.StatusBadRequest, CodeInvalidRequest, "invalid purge id", nil)
+	}
+	job, ok := in.purgeJobs.get(id)
+	if !ok {
+		return apiError(c, http.StatusNotFound, CodeNotFound, "purge not found", nil)
+	}
+	return c.JSON(http.StatusOK, job)
+}
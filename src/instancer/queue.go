@@ -0,0 +1,343 @@
+package instancer
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	utilnet "k8s.io/apimachinery/pkg/util/net"
+)
+
+// Job kinds, used to label the job metrics.
+const (
+	JobDeploy    = "deploy"
+	JobRestart   = "restart"
+	JobDestroy   = "destroy"
+	JobExpire    = "expire"
+	JobReconcile = "reconcile"
+	JobReload    = "reload"
+	JobReady     = "ready"
+
+	// maxRetryBackoff caps the doubling wait between retries
+	maxRetryBackoff = 30 * time.Second
+	// cleanupTimeout bounds the work recording the outcome of a cancelled job
+	cleanupTimeout = 10 * time.Second
+)
+
+// ErrQueueClosed is returned for jobs submitted to or dropped by a stopped queue.
+var ErrQueueClosed = errors.New("job queue is closed")
+
+// jobFunc is the work of a job. Its context is cancelled if the job is preempted or the queue is closed.
+type jobFunc func(ctx context.Context) error
+
+type runningJob struct {
+	kind   string
+	cancel context.CancelFunc
+	// preempted is set once the job has been cancelled by preempt
+	preempted bool
+	// done is closed once a detached job has returned
+	done chan struct{}
+}
+
+type job struct {
+	key      string
+	kind     string
+	run      jobFunc
+	enqueued time.Time
+	// done receives the result of jobs submitted with do
+	done chan error
+}
+
+// jobQueue runs jobs on a fixed number of workers.
+// Jobs sharing a key never run concurrently, and run in the order they were submitted.
+type jobQueue struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	pending []*job
+	// running holds the running jobs by key
+	running map[string]*runningJob
+	// detached holds the jobs running outside the workers by key
+	detached map[string]*runningJob
+	closed   bool
+	wg       sync.WaitGroup
+	log      zerolog.Logger
+	// ctx is the parent of the job contexts, cancelled when the queue is closed
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// newJobQueue starts a queue with the given number of workers.
+func newJobQueue(workers int, log zerolog.Logger) *jobQueue {
+	q := &jobQueue{
+		running:  make(map[string]*runningJob),
+		detached: make(map[string]*runningJob),
+		log:      log.With().Str("component", "jobs").Logger(),
+	}
+	q.cond = sync.NewCond(&q.mu)
+	q.ctx, q.cancel = context.WithCancel(context.Background())
+	for i := 0; i < workers; i++ {
+		q.wg.Add(1)
+		go q.work()
+	}
+	return q
+}
+
+// instanceKey is the key serializing the jobs of an instance.
+func instanceKey(id int64) string {
+	return "instance/" + strconv.FormatInt(id, 10)
+}
+
+// enqueue submits a job without waiting for it. Errors are logged.
+// It reports whether the job was submitted, which fails only once the queue is closed.
+func (q *jobQueue) enqueue(key string, kind string, run jobFunc) bool {
+	return q.submit(&job{key: key, kind: kind, run: run}, false)
+}
+
+// enqueueOnce submits a job unless a job of the same kind and key is already waiting,
+// so periodic jobs do not pile up behind a slow run. It reports whether the job was submitted.
+func (q *jobQueue) enqueueOnce(key string, kind string, run jobFunc) bool {
+	return q.submit(&job{key: key, kind: kind, run: run}, true)
+}
+
+// do submits a job and waits for its result, or until ctx is done. The job still runs if ctx is done first.
+func (q *jobQueue) do(ctx context.Context, key string, kind string, run jobFunc) error {
+	j := &job{key: key, kind: kind, run: run, done: make(chan error, 1)}
+	if !q.submit(j, false) {
+		return ErrQueueClosed
+	}
+	select {
+	case err := <-j.done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (q *jobQueue) submit(j *job, once bool) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return false
+	}
+	if once {
+		for _, p := range q.pending {
+			if p.key == j.key && p.kind == j.kind {
+				return false
+			}
+		}
+	}
+	j.enqueued = time.Now()
+	q.pending = append(q.pending, j)
+	jobQueueDepth.Set(float64(len(q.pending)))
+	q.cond.Broadcast()
+	return true
+}
+
+// preempt cancels the running job and drops the pending jobs with the given key which are of one of kinds,
+// such as a deploy waiting for its instance to become ready when the instance is being destroyed.
+func (q *jobQueue) preempt(key string, kinds ...string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, r := range []*runningJob{q.running[key], q.detached[key]} {
+		if r != nil && slices.Contains(kinds, r.kind) {
+			r.preempted = true
+			r.cancel()
+		}
+	}
+	kept := q.pending[:0]
+	for _, j := range q.pending {
+		if j.key != key || !slices.Contains(kinds, j.kind) {
+			kept = append(kept, j)
+			continue
+		}
+		if j.done != nil {
+			j.done <- context.Canceled
+		}
+		q.log.Debug().Str("kind", j.kind).Str("key", j.key).Msg("dropped preempted job")
+	}
+	q.pending = kept
+	jobQueueDepth.Set(float64(len(q.pending)))
+}
+
+// detach runs a job in its own goroutine instead of on a worker, for long waits such as an instance becoming ready
+// which would otherwise keep a worker from other jobs. It is not serialized with the jobs of its key, but is cancelled
+// by preempt and close like them, and jobs which must not overlap it after it is preempted call awaitPreempted.
+// A detached job submitted by a preempted job of the same key starts cancelled.
+func (q *jobQueue) detach(key string, kind string, run jobFunc) {
+	q.mu.Lock()
+	ctx, cancel := context.WithCancel(q.ctx)
+	d := &runningJob{kind: kind, cancel: cancel, done: make(chan struct{})}
+	if r, ok := q.running[key]; ok && r.preempted {
+		d.preempted = true
+		cancel()
+	}
+	q.detached[key] = d
+	q.wg.Add(1)
+	q.mu.Unlock()
+
+	go func() {
+		defer q.wg.Done()
+		jobsDetached.Inc()
+		start := time.Now()
+		err := run(ctx)
+		result := "success"
+		if err != nil {
+			result = "error"
+			q.log.Error().Err(err).Str("kind", kind).Str("key", key).Msg("job failed")
+		}
+		jobDuration.WithLabelValues(kind, result).Observe(time.Since(start).Seconds())
+		jobsDetached.Dec()
+
+		q.mu.Lock()
+		cancel()
+		if q.detached[key] == d {
+			delete(q.detached, key)
+		}
+		close(d.done)
+		q.mu.Unlock()
+	}()
+}
+
+// awaitPreempted blocks until the preempted detached job of a key has returned, or ctx is done.
+// A cancelled job still records its outcome, which jobs taking over its key must not race with.
+func (q *jobQueue) awaitPreempted(ctx context.Context, key string) error {
+	q.mu.Lock()
+	d := q.detached[key]
+	q.mu.Unlock()
+	if d == nil || !d.preempted {
+		return nil
+	}
+	select {
+	case <-d.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// next waits for the first pending job whose key is not running and marks its key running.
+// It returns nil once the queue is closed and no jobs are pending.
+func (q *jobQueue) next() (*job, context.Context) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for {
+		for i, j := range q.pending {
+			if _, busy := q.running[j.key]; busy {
+				continue
+			}
+			q.pending = append(q.pending[:i], q.pending[i+1:]...)
+			jobQueueDepth.Set(float64(len(q.pending)))
+			ctx, cancel := context.WithCancel(q.ctx)
+			q.running[j.key] = &runningJob{kind: j.kind, cancel: cancel}
+			return j, ctx
+		}
+		if q.closed && len(q.pending) == 0 {
+			return nil, nil
+		}
+		q.cond.Wait()
+	}
+}
+
+func (q *jobQueue) work() {
+	defer q.wg.Done()
+	for {
+		j, ctx := q.next()
+		if j == nil {
+			return
+		}
+		jobWait.WithLabelValues(j.kind).Observe(time.Since(j.enqueued).Seconds())
+		jobsRunning.Inc()
+		start := time.Now()
+		err := j.run(ctx)
+		result := "success"
+		if err != nil {
+			result = "error"
+		}
+		jobDuration.WithLabelValues(j.kind, result).Observe(time.Since(start).Seconds())
+		jobsRunning.Dec()
+
+		if j.done != nil {
+			j.done <- err
+		} else if err != nil {
+			q.log.Error().Err(err).Str("kind", j.kind).Str("key", j.key).Msg("job failed")
+		}
+
+		q.mu.Lock()
+		q.running[j.key].cancel()
+		delete(q.running, j.key)
+		q.mu.Unlock()
+		q.cond.Broadcast()
+	}
+}
+
+// close stops accepting jobs and cancels the context of every job. Running and detached jobs are left to wind down,
+// and pending jobs are run with a cancelled context so each records its outcome, such as a deploy marking
+// its instance failed. It waits for the workers to exit until ctx is done.
+func (q *jobQueue) close(ctx context.Context) error {
+	q.mu.Lock()
+	q.closed = true
+	pending := len(q.pending)
+	q.mu.Unlock()
+	q.cancel()
+	q.cond.Broadcast()
+	q.log.Info().Int("pending", pending).Msg("cancelling background jobs")
+
+	done := make(chan struct{})
+	go func() {
+		q.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// cleanupContext returns a context for recording the outcome of work whose context may already be cancelled.
+func cleanupContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.WithoutCancel(ctx), cleanupTimeout)
+}
+
+// isTransient reports whether a kubernetes request failed in a way which may succeed if retried.
+func isTransient(err error) bool {
+	return apierrors.IsServerTimeout(err) ||
+		apierrors.IsTimeout(err) ||
+		apierrors.IsTooManyRequests(err) ||
+		apierrors.IsServiceUnavailable(err) ||
+		apierrors.IsInternalError(err) ||
+		apierrors.IsUnexpectedServerError(err) ||
+		utilnet.IsConnectionReset(err) ||
+		utilnet.IsConnectionRefused(err) ||
+		utilnet.IsProbableEOF(err)
+}
+
+// retryTransient calls fn until it succeeds, fails with an error which is not transient, or job-retries is exhausted.
+// The wait between attempts starts at job-retry-backoff and doubles, unless the apiserver asks for a longer delay.
+func (in *Instancer) retryTransient(ctx context.Context, op string, fn func() error) error {
+	backoff := in.conf.JobRetryBackoff
+	for attempt := 0; ; attempt++ {
+		err := fn()
+		if err == nil || attempt >= in.conf.JobRetries || !isTransient(err) {
+			return err
+		}
+		wait := backoff
+		if seconds, ok := apierrors.SuggestsClientDelay(err); ok && time.Duration(seconds)*time.Second > wait {
+			wait = time.Duration(seconds) * time.Second
+		}
+		apiserverRetries.WithLabelValues(op).Inc()
+		in.log.Debug().Err(err).Str("component", "jobs").Str("operation", op).Dur("wait", wait).Msg("retrying kubernetes request")
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(wait):
+		}
+		backoff = min(backoff*2, maxRetryBackoff)
+	}
+}
@@ -0,0 +1,352 @@
+package instancer
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+const testWait = 5 * time.Second
+
+func newTestQueue(t *testing.T, workers int) *jobQueue {
+	q := newJobQueue(workers, zerolog.Nop())
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), testWait)
+		defer cancel()
+		if err := q.close(ctx); err != nil {
+			t.Errorf("queue did not close: %v", err)
+		}
+	})
+	return q
+}
+
+// waitFor fails the test if ch is not closed in time.
+func waitFor(t *testing.T, ch <-chan struct{}, what string) {
+	t.Helper()
+	select {
+	case <-ch:
+	case <-time.After(testWait):
+		t.Fatalf("timed out waiting for %v", what)
+	}
+}
+
+func TestJobQueueSerializesKey(t *testing.T) {
+	q := newTestQueue(t, 4)
+
+	var mu sync.Mutex
+	var order []int
+	var running, maxRunning int32
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		i := i
+		wg.Add(1)
+		q.enqueue("a", JobDeploy, func(ctx context.Context) error {
+			defer wg.Done()
+			n := atomic.AddInt32(&running, 1)
+			defer atomic.AddInt32(&running, -1)
+			mu.Lock()
+			maxRunning = max(maxRunning, n)
+			order = append(order, i)
+			mu.Unlock()
+			time.Sleep(time.Millisecond)
+			return nil
+		})
+	}
+	wg.Wait()
+
+	if maxRunning != 1 {
+		t.Errorf("%v jobs of one key ran concurrently", maxRunning)
+	}
+	for i, v := range order {
+		if i != v {
+			t.Fatalf("jobs ran out of order: %v", order)
+		}
+	}
+}
+
+func TestJobQueueRunsKeysConcurrently(t *testing.T) {
+	q := newTestQueue(t, 2)
+
+	// Each job waits for the other to start, which only happens if both run at once
+	aStarted, bStarted := make(chan struct{}), make(chan struct{})
+	overlapped := make(chan bool, 2)
+	meet := func(started chan struct{}, other chan struct{}) jobFunc {
+		return func(ctx context.Context) error {
+			close(started)
+			select {
+			case <-other:
+				overlapped <- true
+			case <-time.After(testWait):
+				overlapped <- false
+			}
+			return nil
+		}
+	}
+	q.enqueue("a", JobDeploy, meet(aStarted, bStarted))
+	q.enqueue("b", JobDeploy, meet(bStarted, aStarted))
+	for i := 0; i < 2; i++ {
+		if !<-overlapped {
+			t.Fatal("jobs of different keys did not run concurrently")
+		}
+	}
+}
+
+func TestJobQueuePreempt(t *testing.T) {
+	q := newTestQueue(t, 2)
+
+	started, cancelled := make(chan struct{}), make(chan struct{})
+	q.enqueue("a", JobDeploy, func(ctx context.Context) error {
+		close(started)
+		<-ctx.Done()
+		close(cancelled)
+		return ctx.Err()
+	})
+	waitFor(t, started, "deploy")
+
+	var pendingRan atomic.Bool
+	pending := make(chan error, 1)
+	go func() {
+		pending <- q.do(context.Background(), "a", JobRestart, func(ctx context.Context) error {
+			pendingRan.Store(true)
+			return nil
+		})
+	}()
+	// Wait for the restart to be queued behind the deploy
+	for deadline := time.Now().Add(testWait); ; {
+		q.mu.Lock()
+		n := len(q.pending)
+		q.mu.Unlock()
+		if n == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("restart was not queued")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	q.preempt("a", JobDeploy, JobRestart)
+	waitFor(t, cancelled, "deploy to be cancelled")
+	if err := <-pending; !errors.Is(err, context.Canceled) {
+		t.Errorf("preempted pending job returned %v, want context.Canceled", err)
+	}
+
+	err := q.do(context.Background(), "a", JobDestroy, func(ctx context.Context) error { return ctx.Err() })
+	if err != nil {
+		t.Errorf("destroy after preempt returned %v", err)
+	}
+	if pendingRan.Load() {
+		t.Error("preempted pending job ran")
+	}
+}
+
+func TestJobQueueEnqueueOnce(t *testing.T) {
+	q := newTestQueue(t, 1)
+
+	// Hold the key so the deduplicated jobs stay pending
+	started, release := make(chan struct{}), make(chan struct{})
+	q.enqueue("a", JobDeploy, func(ctx context.Context) error {
+		close(started)
+		<-release
+		return nil
+	})
+	waitFor(t, started, "blocking job")
+
+	var runs atomic.Int32
+	run := func(ctx context.Context) error {
+		runs.Add(1)
+		return nil
+	}
+	if !q.enqueueOnce("a", JobExpire, run) {
+		t.Error("first enqueueOnce was not submitted")
+	}
+	if q.enqueueOnce("a", JobExpire, run) {
+		t.Error("enqueueOnce submitted a duplicate of a pending job")
+	}
+	if !q.enqueueOnce("a", JobReconcile, run) {
+		t.Error("enqueueOnce deduplicated a job of another kind")
+	}
+	close(release)
+
+	if err := q.do(context.Background(), "a", JobExpire, func(ctx context.Context) error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+	if n := runs.Load(); n != 2 {
+		t.Errorf("%v deduplicated jobs ran, want 2", n)
+	}
+}
+
+func TestJobQueueCloseDrainsPending(t *testing.T) {
+	q := newJobQueue(1, zerolog.Nop())
+
+	started, release := make(chan struct{}), make(chan struct{})
+	q.enqueue("a", JobDeploy, func(ctx context.Context) error {
+		close(started)
+		<-release
+		return nil
+	})
+	waitFor(t, started, "blocking job")
+
+	var drained []error
+	var mu sync.Mutex
+	for i := 0; i < 3; i++ {
+		q.enqueue("b", JobDeploy, func(ctx context.Context) error {
+			mu.Lock()
+			drained = append(drained, ctx.Err())
+			mu.Unlock()
+			return nil
+		})
+	}
+
+	closed := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), testWait)
+		defer cancel()
+		closed <- q.close(ctx)
+	}()
+	// Jobs cannot be submitted while the queue is closing
+	for !queueClosed(q) {
+		time.Sleep(time.Millisecond)
+	}
+	if q.enqueue("c", JobDeploy, func(ctx context.Context) error { return nil }) {
+		t.Error("enqueue succeeded on a closed queue")
+	}
+	if err := q.do(context.Background(), "c", JobDestroy, func(ctx context.Context) error { return nil }); !errors.Is(err, ErrQueueClosed) {
+		t.Errorf("do on a closed queue returned %v, want ErrQueueClosed", err)
+	}
+	close(release)
+
+	if err := <-closed; err != nil {
+		t.Fatalf("close returned %v", err)
+	}
+	if len(drained) != 3 {
+		t.Fatalf("%v pending jobs ran on close, want 3", len(drained))
+	}
+	for _, err := range drained {
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("pending job ran with context error %v, want context.Canceled", err)
+		}
+	}
+}
+
+func TestJobQueueCloseTimeout(t *testing.T) {
+	q := newJobQueue(1, zerolog.Nop())
+
+	started, release := make(chan struct{}), make(chan struct{})
+	defer close(release)
+	q.enqueue("a", JobDeploy, func(ctx context.Context) error {
+		close(started)
+		<-release
+		return nil
+	})
+	waitFor(t, started, "blocking job")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := q.close(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("close returned %v, want context.DeadlineExceeded", err)
+	}
+}
+
+func TestJobQueueDetach(t *testing.T) {
+	q := newTestQueue(t, 1)
+
+	detached, cancelled := make(chan struct{}), make(chan struct{})
+	err := q.do(context.Background(), "a", JobDeploy, func(ctx context.Context) error {
+		q.detach("a", JobReady, func(ctx context.Context) error {
+			close(detached)
+			<-ctx.Done()
+			close(cancelled)
+			return nil
+		})
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, detached, "detached job")
+
+	// The detached job must not hold the only worker
+	if err := q.do(context.Background(), "b", JobDestroy, func(ctx context.Context) error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+
+	q.preempt("a", JobReady)
+	waitFor(t, cancelled, "detached job to be cancelled")
+}
+
+func TestJobQueueDetachFromPreemptedJob(t *testing.T) {
+	q := newTestQueue(t, 1)
+
+	started, preempted := make(chan struct{}), make(chan struct{})
+	detachedErr := make(chan error, 1)
+	q.enqueue("a", JobDeploy, func(ctx context.Context) error {
+		close(started)
+		<-preempted
+		q.detach("a", JobReady, func(ctx context.Context) error {
+			detachedErr <- ctx.Err()
+			return nil
+		})
+		return nil
+	})
+	waitFor(t, started, "deploy")
+	q.preempt("a", JobDeploy, JobReady)
+	close(preempted)
+
+	select {
+	case err := <-detachedErr:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("detached job of a preempted job ran with context error %v, want context.Canceled", err)
+		}
+	case <-time.After(testWait):
+		t.Fatal("timed out waiting for detached job")
+	}
+}
+
+func TestJobQueueAwaitPreempted(t *testing.T) {
+	q := newTestQueue(t, 1)
+
+	detached, cancelled, release := make(chan struct{}), make(chan struct{}), make(chan struct{})
+	q.detach("a", JobReady, func(ctx context.Context) error {
+		close(detached)
+		<-ctx.Done()
+		close(cancelled)
+		// A cancelled job still records its outcome
+		<-release
+		return nil
+	})
+	waitFor(t, detached, "detached job")
+	if err := q.awaitPreempted(context.Background(), "a"); err != nil {
+		t.Fatalf("waited for a detached job which was not preempted: %v", err)
+	}
+
+	q.preempt("a", JobReady)
+	destroyed := make(chan struct{})
+	q.enqueue("a", JobDestroy, func(ctx context.Context) error {
+		if err := q.awaitPreempted(ctx, "a"); err != nil {
+			return err
+		}
+		close(destroyed)
+		return nil
+	})
+	waitFor(t, cancelled, "detached job to be cancelled")
+	select {
+	case <-destroyed:
+		t.Fatal("destroy ran before the preempted detached job returned")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	waitFor(t, destroyed, "destroy")
+}
+
+// queueClosed reports whether close has been called on q.
+func queueClosed(q *jobQueue) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.closed
+}
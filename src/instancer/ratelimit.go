@@ -0,0 +1,175 @@
+package instancer
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"golang.org/x/time/rate"
+)
+
+const (
+	// LimitTeam is the token bucket of a team.
+	LimitTeam = "team"
+	// LimitIP is the token bucket of a client address.
+	LimitIP = "ip"
+	// LimitCooldown is the wait after destroying an instance before recreating it.
+	LimitCooldown = "cooldown"
+
+	// limiterPruneInterval is how often idle token buckets are dropped
+	limiterPruneInterval = 10 * time.Minute
+)
+
+// RateLimitedResponse is returned when a request is rejected by a rate limit or cooldown.
+type RateLimitedResponse struct {
+	Error string `json:"error"`
+	Limit string `json:"limit"`
+	// RetryAfter is the number of seconds until the request may be retried
+	RetryAfter int `json:"retry_after"`
+}
+
+type limiterEntry struct {
+	lim      *rate.Limiter
+	lastSeen time.Time
+}
+
+// keyedLimiter holds a token bucket per key, such as a team or client address.
+type keyedLimiter struct {
+	mu        sync.Mutex
+	limit     rate.Limit
+	burst     int
+	limiters  map[string]*limiterEntry
+	lastPrune time.Time
+}
+
+// newKeyedLimiter returns a limiter allowing perMinute requests per key with bursts of burst requests,
+// or nil if perMinute is not positive.
+func newKeyedLimiter(perMinute float64, burst int) *keyedLimiter {
+	if perMinute <= 0 {
+		return nil
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	return &keyedLimiter{
+		limit:    rate.Limit(perMinute / 60),
+		burst:    burst,
+		limiters: make(map[string]*limiterEntry),
+	}
+}
+
+// reserve takes a token from the bucket of key. If none is available no token is taken,
+// and the time until one is available is returned.
+func (l *keyedLimiter) reserve(key string, now time.Time) (time.Duration, func()) {
+	if l == nil {
+		return 0, func() {}
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.prune(now)
+	e, ok := l.limiters[key]
+	if !ok {
+		e = &limiterEntry{lim: rate.NewLimiter(l.limit, l.burst)}
+		l.limiters[key] = e
+	}
+	e.lastSeen = now
+	r := e.lim.ReserveN(now, 1)
+	if delay := r.DelayFrom(now); delay > 0 {
+		r.CancelAt(now)
+		return delay, func() {}
+	}
+	return 0, func() { r.CancelAt(now) }
+}
+
+// prune drops the buckets which have been idle long enough to refill completely.
+// The caller must hold l.mu.
+func (l *keyedLimiter) prune(now time.Time) {
+	if now.Sub(l.lastPrune) < limiterPruneInterval {
+		return
+	}
+	l.lastPrune = now
+	refill := time.Duration(float64(l.burst) / float64(l.limit) * float64(time.Second))
+	for k, e := range l.limiters {
+		if now.Sub(e.lastSeen) > refill {
+			delete(l.limiters, k)
+		}
+	}
+}
+
+// cooldownTracker remembers when each team destroyed an instance of each challenge.
+type cooldownTracker struct {
+	mu       sync.Mutex
+	duration time.Duration
+	until    map[string]time.Time
+}
+
+func newCooldownTracker(duration time.Duration) *cooldownTracker {
+	return &cooldownTracker{
+		duration: duration,
+		until:    make(map[string]time.Time),
+	}
+}
+
+func cooldownKey(team string, challenge string) string {
+	return team + "\x00" + challenge
+}
+
+// start begins the cooldown of a team for a challenge.
+func (t *cooldownTracker) start(team string, challenge string, now time.Time) {
+	if t.duration <= 0 {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for k, until := range t.until {
+		if !now.Before(until) {
+			delete(t.until, k)
+		}
+	}
+	t.until[cooldownKey(team, challenge)] = now.Add(t.duration)
+}
+
+// remaining returns how long a team must wait before creating an instance of a challenge.
+func (t *cooldownTracker) remaining(team string, challenge string, now time.Time) time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	until, ok := t.until[cooldownKey(team, challenge)]
+	if !ok || !now.Before(until) {
+		return 0
+	}
+	return until.Sub(now)
+}
+
+// checkRateLimits takes a token from the buckets of the client address and team of a request.
+// If either is empty no token is taken from the other, and the exhausted limit is returned with the time until a retry.
+func (in *Instancer) checkRateLimits(c echo.Context, team string) (string, time.Duration) {
+	now := time.Now()
+	delay, cancelIP := in.ipLimiter.reserve(c.RealIP(), now)
+	if delay > 0 {
+		return LimitIP, delay
+	}
+	delay, _ = in.teamLimiter.reserve(team, now)
+	if delay > 0 {
+		cancelIP()
+		return LimitTeam, delay
+	}
+	return "", 0
+}
+
+// setRetryAfter counts a request rejected by limit and sets its Retry-After header, returning the seconds to wait.
+func setRetryAfter(c echo.Context, limit string, retry time.Duration) int {
+	seconds := int(math.Ceil(retry.Seconds()))
+	rateLimitRejected.WithLabelValues(limit, c.Request().Method).Inc()
+	c.Response().Header().Set("Retry-After", strconv.Itoa(seconds))
+	return seconds
+}
+
+// rateLimited responds to a request rejected by limit, setting the Retry-After header.
+func rateLimited(c echo.Context, limit string, retry time.Duration, msg string) error {
+	seconds := setRetryAfter(c, limit, retry)
+	return c.JSON(http.StatusTooManyRequests, RateLimitedResponse{msg, limit, seconds})
+}
@@ -0,0 +1,148 @@
+package instancer
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/ubcctf/instanced/src/db"
+	"github.com/ubcctf/instanced/src/k8s"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// ReconcileInstances compares the instance objects in the cluster with the instance records in the database.
+// Objects labelled as managed by instanced without a matching record are deleted, and records whose objects
+// have all vanished are marked as missing. Objects and records younger than the reconcile grace period are
+// ignored, so instances which are still being created or destroyed are left alone.
+// In dry-run mode the actions are only logged.
+func (in *Instancer) ReconcileInstances(ctx context.Context) {
+	log := in.log.With().Str("component", "reconciler").Bool("dry-run", in.conf.ReconcileDryRun).Logger()
+	reconcileRuns.Inc()
+	dryRun := strconv.FormatBool(in.conf.ReconcileDryRun)
+	cutoff := time.Now().Add(-in.conf.ReconcileGrace)
+
+	// Objects are listed before records are read. Records are inserted before their objects are created,
+	// so every listed object of a live instance has its record in the snapshot.
+	selector := labels.SelectorFromSet(labels.Set{LabelManagedBy: managedByValue}).String()
+	objs := make([]unstructured.Unstructured, 0)
+	for _, gvk := range in.reconcileKinds(ctx) {
+		list, err := in.k8sC.ListObjects(ctx, gvk, in.conf.Namespace, selector)
+		if err != nil {
+			reconcileErrors.Inc()
+			log.Error().Err(err).Str("kind", gvk.Kind).Msg("error listing instance objects")
+			return
+		}
+		objs = append(objs, list...)
+	}
+	namespaces, err := in.k8sC.ListObjects(ctx, schema.GroupVersionKind{Version: "v1", Kind: "Namespace"}, "", selector)
+	if err != nil {
+		reconcileErrors.Inc()
+		log.Error().Err(err).Msg("error listing instance namespaces")
+		return
+	}
+	objs = append(objs, namespaces...)
+
+	records, err := in.dbC.ReadInstanceRecords(ctx)
+	if err != nil {
+		reconcileErrors.Inc()
+		log.Error().Err(err).Msg("error reading instance records")
+		return
+	}
+	known := make(map[string]bool, len(records))
+	for _, r := range records {
+		known[labelValue(r.UUID)] = true
+	}
+
+	found := make(map[string]bool)
+	orphans := 0
+	for i := range objs {
+		obj := &objs[i]
+		id := obj.GetLabels()[LabelInstanceID]
+		found[id] = true
+		if known[id] || obj.GetCreationTimestamp().Time.After(cutoff) {
+			continue
+		}
+		orphans++
+		reconcileOrphans.WithLabelValues(obj.GetKind(), dryRun).Inc()
+		log.Info().Str("kind", obj.GetKind()).
+			Str("name", obj.GetName()).
+			Str("namespace", obj.GetNamespace()).
+			Str("instance-id", id).
+			Msg("deleting object without instance record")
+		if in.conf.ReconcileDryRun {
+			continue
+		}
+		err := in.k8sC.DeleteObject(ctx, obj, obj.GetNamespace())
+		if err != nil {
+			reconcileErrors.Inc()
+			log.Error().Err(err).Str("kind", obj.GetKind()).Str("name", obj.GetName()).Msg("error deleting orphaned object")
+		}
+	}
+
+	missing := 0
+	for _, r := range records {
+		// Records created before objects were labelled cannot be matched, and only
+		// ready instances are expected to have objects
+		if len(r.Kinds) == 0 || r.State != db.StateReady || r.Created.After(cutoff) {
+			continue
+		}
+		vanished := !found[labelValue(r.UUID)]
+		if vanished == r.Missing {
+			continue
+		}
+		if vanished {
+			missing++
+			reconcileMissing.WithLabelValues(dryRun).Inc()
+			log.Info().Int64("id", r.Id).Str("challenge", r.Challenge).Msg("marking instance with vanished objects as missing")
+		} else {
+			log.Info().Int64("id", r.Id).Str("challenge", r.Challenge).Msg("objects of missing instance found")
+		}
+		if in.conf.ReconcileDryRun {
+			continue
+		}
+		err := in.dbC.SetInstanceMissing(ctx, r.Id, vanished)
+		if err != nil {
+			reconcileErrors.Inc()
+			log.Error().Err(err).Int64("id", r.Id).Msg("error marking instance record")
+		}
+	}
+	log.Info().Int("orphaned-objects", orphans).Int("missing-instances", missing).Msg("reconciled instances")
+}
+
+// reconcileKinds returns the kinds of namespaced objects which may belong to an instance:
+// those used by the loaded challenges and those recorded for existing instances.
+func (in *Instancer) reconcileKinds(ctx context.Context) []schema.GroupVersionKind {
+	kinds := make([]db.ObjectKind, 0)
+	seen := make(map[db.ObjectKind]bool)
+	add := func(k db.ObjectKind) {
+		if !seen[k] {
+			seen[k] = true
+			kinds = append(kinds, k)
+		}
+	}
+	for _, c := range in.challenges.List() {
+		objs, err := renderChallengeObjs(c.ChallengeDefinition, k8s.ChalInstIdentifier{ID: "reconcile", Challenge: c.Name, Namespace: in.conf.Namespace})
+		if err != nil {
+			continue
+		}
+		for _, k := range objectKinds(objs) {
+			add(k)
+		}
+	}
+	records, err := in.dbC.ReadInstanceRecords(ctx)
+	if err == nil {
+		for _, r := range records {
+			for _, k := range r.Kinds {
+				add(k)
+			}
+		}
+	}
+
+	res := make([]schema.GroupVersionKind, 0, len(kinds))
+	for _, k := range kinds {
+		res = append(res, schema.FromAPIVersionAndKind(k.APIVersion, k.Kind))
+	}
+	return res
+}
@@ -0,0 +1,141 @@
+package instancer
+
+import (
+	"maps"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ubcctf/instanced/src/k8s"
+)
+
+// RegisteredChallenge is a challenge definition loaded into the registry.
+type RegisteredChallenge struct {
+	k8s.ChallengeDefinition
+	// Version increases every time a definition is loaded into the registry.
+	Version  uint64
+	LoadedAt time.Time
+}
+
+// RegistryDiff lists the names of challenges which differ between the registry and a set of definitions.
+type RegistryDiff struct {
+	Added   []string `json:"added"`
+	Updated []string `json:"updated"`
+	Removed []string `json:"removed"`
+}
+
+// empty reports whether the diff contains no changes.
+func (d RegistryDiff) empty() bool {
+	return len(d.Added) == 0 && len(d.Updated) == 0 && len(d.Removed) == 0
+}
+
+// ChallengeRegistry holds the loaded challenge definitions and is safe for concurrent use.
+// Definitions are immutable once loaded, so values returned by the registry are consistent
+// snapshots which are unaffected by later updates.
+type ChallengeRegistry struct {
+	mu      sync.RWMutex
+	defs    map[string]RegisteredChallenge
+	version uint64
+}
+
+func NewChallengeRegistry() *ChallengeRegistry {
+	return &ChallengeRegistry{
+		defs: make(map[string]RegisteredChallenge),
+	}
+}
+
+// Get returns the definition of a challenge.
+func (r *ChallengeRegistry) Get(name string) (RegisteredChallenge, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	def, ok := r.defs[name]
+	return def, ok
+}
+
+// List returns every loaded definition sorted by name.
+func (r *ChallengeRegistry) List() []RegisteredChallenge {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	res := make([]RegisteredChallenge, 0, len(r.defs))
+	for _, def := range r.defs {
+		res = append(res, def)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Name < res[j].Name
+	})
+	return res
+}
+
+// Put loads a definition, replacing any previous definition of the same challenge.
+func (r *ChallengeRegistry) Put(def k8s.ChallengeDefinition) RegisteredChallenge {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.put(def)
+}
+
+func (r *ChallengeRegistry) put(def k8s.ChallengeDefinition) RegisteredChallenge {
+	r.version++
+	reg := RegisteredChallenge{
+		ChallengeDefinition: def,
+		Version:             r.version,
+		LoadedAt:            time.Now(),
+	}
+	r.defs[def.Name] = reg
+	return reg
+}
+
+// Remove unloads a challenge, reporting whether it was loaded.
+func (r *ChallengeRegistry) Remove(name string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_, ok := r.defs[name]
+	delete(r.defs, name)
+	return ok
+}
+
+// diff compares the registry with a set of definitions keyed by challenge name.
+// A challenge is updated when the generation of its CRD differs.
+func (r *ChallengeRegistry) diff(defs map[string]k8s.ChallengeDefinition) RegistryDiff {
+	diff := RegistryDiff{}
+	for name, def := range defs {
+		cur, ok := r.defs[name]
+		if !ok {
+			diff.Added = append(diff.Added, name)
+		} else if cur.Generation != def.Generation {
+			diff.Updated = append(diff.Updated, name)
+		}
+	}
+	for name := range r.defs {
+		if _, ok := defs[name]; !ok {
+			diff.Removed = append(diff.Removed, name)
+		}
+	}
+	sort.Strings(diff.Added)
+	sort.Strings(diff.Updated)
+	sort.Strings(diff.Removed)
+	return diff
+}
+
+// Replace atomically replaces the contents of the registry with defs and returns the changes made.
+// Unchanged definitions keep their version. Challenges named in rejected exist but could not be parsed,
+// so like an invalid update seen by the CRD watcher they keep their loaded definition instead of being removed.
+func (r *ChallengeRegistry) Replace(defs map[string]k8s.ChallengeDefinition, rejected []string) RegistryDiff {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	kept := make(map[string]k8s.ChallengeDefinition, len(defs)+len(rejected))
+	maps.Copy(kept, defs)
+	for _, name := range rejected {
+		if cur, ok := r.defs[name]; ok {
+			kept[name] = cur.ChallengeDefinition
+		}
+	}
+	defs = kept
+	diff := r.diff(defs)
+	for _, name := range diff.Removed {
+		delete(r.defs, name)
+	}
+	for _, name := range append(diff.Added, diff.Updated...) {
+		r.put(defs[name])
+	}
+	return diff
+}
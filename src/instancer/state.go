@@ -0,0 +1,62 @@
+package instancer
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/ubcctf/instanced/src/db"
+)
+
+// transitions lists the states each instance state may move to.
+// Terminating may be re-entered so destroying an instance can be retried.
+// Ready and failed instances return to provisioning when restarted.
+var transitions = map[db.InstanceState][]db.InstanceState{
+	db.StateProvisioning: {db.StateReady, db.StateFailed, db.StateTerminating},
+	db.StateReady:        {db.StateProvisioning, db.StateTerminating},
+	db.StateFailed:       {db.StateProvisioning, db.StateTerminating},
+	db.StateTerminating:  {db.StateTerminating, db.StateDestroyed},
+	db.StateDestroyed:    {},
+}
+
+// validTransition reports whether an instance may move from state from to state to.
+func validTransition(from db.InstanceState, to db.InstanceState) bool {
+	for _, s := range transitions[from] {
+		if s == to {
+			return true
+		}
+	}
+	return false
+}
+
+// InvalidTransitionError is returned when an instance cannot move to the requested state.
+type InvalidTransitionError struct {
+	id   int64
+	from db.InstanceState
+	to   db.InstanceState
+}
+
+func (e *InvalidTransitionError) Error() string {
+	return fmt.Sprintf("instance %v cannot move from %v to %v", e.id, e.from, e.to)
+}
+
+// transitionInstance moves an instance to state to, recording reason as the cause of a failure.
+// The transition is applied only if the instance is still in the state of rec.
+func (in *Instancer) transitionInstance(ctx context.Context, rec db.InstanceRecord, to db.InstanceState, reason error) (db.InstanceRecord, error) {
+	if !validTransition(rec.State, to) {
+		return db.InstanceRecord{}, &InvalidTransitionError{rec.Id, rec.State, to}
+	}
+	msg := ""
+	if reason != nil {
+		msg = reason.Error()
+	}
+	res, err := in.dbC.UpdateInstanceState(ctx, rec.Id, rec.State, to, msg)
+	if err != nil {
+		return db.InstanceRecord{}, err
+	}
+	in.log.Debug().Str("component", "instanced").
+		Int64("id", rec.Id).
+		Str("from", string(rec.State)).
+		Str("to", string(to)).
+		Msg("instance changed state")
+	return res, nil
+}
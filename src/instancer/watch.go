@@ -0,0 +1,103 @@
+package instancer
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/ubcctf/instanced/src/k8s"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/tools/cache"
+)
+
+// WatchCRDs keeps the loaded challenges in sync with the InstancedChallenge CRDs until ctx is cancelled.
+// Challenges are added, updated and removed as CRDs are applied, and the leader writes the result of
+// validating each CRD to its status subresource.
+func (in *Instancer) WatchCRDs(ctx context.Context) {
+	log := in.log.With().Str("component", "crd-watcher").Logger()
+	informer, err := in.k8sC.NewInstancedChallengeInformer(in.conf.Namespace, 10*time.Minute)
+	if err != nil {
+		log.Error().Err(err).Msg("could not create challenge informer")
+		return
+	}
+	_, err = informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			in.applyChallenge(ctx, obj)
+		},
+		UpdateFunc: func(_, obj interface{}) {
+			in.applyChallenge(ctx, obj)
+		},
+		DeleteFunc: func(obj interface{}) {
+			in.removeChallenge(obj)
+		},
+	})
+	if err != nil {
+		log.Error().Err(err).Msg("could not register challenge informer handlers")
+		return
+	}
+	log.Info().Str("namespace", in.conf.Namespace).Msg("watching challenge CRDs")
+	informer.Run(ctx.Done())
+}
+
+// applyChallenge parses an added or updated InstancedChallenge and updates the loaded challenges.
+// An invalid update keeps the previously loaded definition of the challenge, if any.
+func (in *Instancer) applyChallenge(ctx context.Context, obj interface{}) {
+	log := in.log.With().Str("component", "crd-watcher").Logger()
+	c, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		log.Warn().Msg("received unexpected object from challenge informer")
+		return
+	}
+
+	status := k8s.ChallengeStatus{Valid: true, ObservedGeneration: c.GetGeneration()}
+	def, err := k8s.ParseInstancedChallenge(c)
+	switch {
+	case errors.Is(err, k8s.ErrChallengeHidden):
+		in.challenges.Remove(c.GetName())
+		status.Message = "challenge is hidden"
+		log.Info().Str("challenge", c.GetName()).Msg("hid challenge")
+	case err != nil:
+		status.Valid = false
+		status.Message = err.Error()
+		if _, ok := in.challenges.Get(c.GetName()); ok {
+			status.Message += "; the previous version remains loaded"
+		}
+		log.Error().Err(err).Str("challenge", c.GetName()).Msg("rejected challenge")
+	default:
+		status.Message = "challenge loaded"
+		cur, ok := in.challenges.Get(c.GetName())
+		if ok && cur.Generation == def.Generation {
+			// Resyncs and status updates do not change the spec
+			break
+		}
+		reg := in.challenges.Put(def)
+		log.Info().Str("challenge", c.GetName()).
+			Uint64("version", reg.Version).
+			Dur("ttl", in.challengeTTL(def)).
+			Dur("max-ttl", in.challengeMaxTTL(def)).
+			Msg("loaded challenge")
+	}
+
+	// Every replica loads the challenge, only the leader reports it. A new leader catches up on the next resync
+	if !in.isLeader() {
+		return
+	}
+	err = in.k8sC.UpdateInstancedChallengeStatus(ctx, c, status)
+	if err != nil {
+		log.Warn().Err(err).Str("challenge", c.GetName()).Msg("could not update challenge status")
+	}
+}
+
+// removeChallenge unloads a deleted InstancedChallenge.
+func (in *Instancer) removeChallenge(obj interface{}) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	c, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		in.log.Warn().Str("component", "crd-watcher").Msg("received unexpected object from challenge informer")
+		return
+	}
+	in.challenges.Remove(c.GetName())
+	in.log.Info().Str("component", "crd-watcher").Str("challenge", c.GetName()).Msg("removed challenge")
+}
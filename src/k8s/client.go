@@ -2,20 +2,47 @@ package k8s
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"strings"
+	"sync"
+	"time"
 
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/watch"
 
 	"k8s.io/client-go/discovery"
 	"k8s.io/client-go/dynamic"
+	coordinationv1client "k8s.io/client-go/kubernetes/typed/coordination/v1"
 	"k8s.io/client-go/rest"
-	"k8s.io/client-go/restmapper"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
 )
 
+// requestTimeout bounds every request to the apiserver other than watches, as a backstop for requests whose
+// context has no deadline. It is applied to the context of each call, since a client timeout would also end watches.
+const requestTimeout = time.Minute
+
+// requestContext bounds a single request to the apiserver by requestTimeout, keeping any earlier deadline of ctx.
+func requestContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(ctx, requestTimeout)
+}
+
 type KubeClient struct {
+	// Config has no client timeout, so it is shared by watches and informers
 	*rest.Config
+	discovery discovery.DiscoveryInterface
+	// resources caches the Resource of each object Kind, shared by every request
+	resources *resourceCache
+}
+
+type resourceCache struct {
+	mu        sync.Mutex
+	resources map[schema.GroupVersionKind]schema.GroupVersionResource
 }
 
 func NewKubeClient() (KubeClient, error) {
@@ -24,17 +51,38 @@ func NewKubeClient() (KubeClient, error) {
 		return KubeClient{}, err
 	}
 	rest.SetKubernetesDefaults(conf)
+	return NewKubeClientForConfig(conf)
+}
+
+// NewKubeClientForConfig returns a client of the apiserver described by conf.
+func NewKubeClientForConfig(conf *rest.Config) (KubeClient, error) {
+	dc, err := discovery.NewDiscoveryClientForConfig(conf)
+	if err != nil {
+		return KubeClient{}, err
+	}
 	return KubeClient{
-		conf,
+		Config:    conf,
+		discovery: dc,
+		resources: &resourceCache{resources: make(map[schema.GroupVersionKind]schema.GroupVersionResource)},
 	}, nil
 }
 
+// RequestConfig returns a copy of the client config whose requests time out after requestTimeout,
+// for clients such as the record store which never watch.
+func (k *KubeClient) RequestConfig() *rest.Config {
+	conf := rest.CopyConfig(k.Config)
+	conf.Timeout = requestTimeout
+	return conf
+}
+
 // CreateObject creates an object in a namespace. Authentication and api client settings are taken from the instancer config.
 // This procedure first requests the apiserver for the mapping of the object Kind to object Resource, then makes the request
 // to create an object of that Resource using unstructObj as the specification.
 // https://book.kubebuilder.io/cronjob-tutorial/gvks.html
-func (k *KubeClient) CreateObject(unstructObj *unstructured.Unstructured, namespace string) (*unstructured.Unstructured, error) {
-	resource, err := k.GetObjectResource(unstructObj)
+func (k *KubeClient) CreateObject(ctx context.Context, unstructObj *unstructured.Unstructured, namespace string) (*unstructured.Unstructured, error) {
+	ctx, cancel := requestContext(ctx)
+	defer cancel()
+	resource, err := k.GetObjectResource(ctx, unstructObj)
 	if err != nil {
 		return nil, err
 	}
@@ -44,7 +92,7 @@ func (k *KubeClient) CreateObject(unstructObj *unstructured.Unstructured, namesp
 		return nil, err
 	}
 
-	resObj, err := client.Resource(resource).Namespace(namespace).Create(context.TODO(), unstructObj, metav1.CreateOptions{})
+	resObj, err := client.Resource(resource).Namespace(namespace).Create(ctx, unstructObj, metav1.CreateOptions{})
 	if err != nil {
 		return nil, err
 	}
@@ -52,8 +100,10 @@ func (k *KubeClient) CreateObject(unstructObj *unstructured.Unstructured, namesp
 	return resObj, nil
 }
 
-func (k *KubeClient) DeleteObject(unstructObj *unstructured.Unstructured, namespace string) error {
-	resource, err := k.GetObjectResource(unstructObj)
+func (k *KubeClient) DeleteObject(ctx context.Context, unstructObj *unstructured.Unstructured, namespace string) error {
+	ctx, cancel := requestContext(ctx)
+	defer cancel()
+	resource, err := k.GetObjectResource(ctx, unstructObj)
 	if err != nil {
 		return err
 	}
@@ -68,15 +118,18 @@ func (k *KubeClient) DeleteObject(unstructObj *unstructured.Unstructured, namesp
 		return err
 	}
 
-	if err := client.Resource(resource).Namespace(namespace).Delete(context.TODO(), unstructObj.GetName(), deleteOptions); err != nil {
+	if err := client.Resource(resource).Namespace(namespace).Delete(ctx, unstructObj.GetName(), deleteOptions); err != nil {
 		return err
 	}
 
 	return nil
 }
 
-func (k *KubeClient) ListObjects(conf *rest.Config, unstructObj *unstructured.Unstructured, namespace string) ([]string, error) {
-	resource, err := k.GetObjectResource(unstructObj)
+// ListObjects lists the objects of a Kind in a namespace matching a label selector.
+func (k *KubeClient) ListObjects(ctx context.Context, gvk schema.GroupVersionKind, namespace string, selector string) ([]unstructured.Unstructured, error) {
+	ctx, cancel := requestContext(ctx)
+	defer cancel()
+	resource, err := k.GetKindResource(ctx, gvk)
 	if err != nil {
 		return nil, err
 	}
@@ -86,38 +139,247 @@ func (k *KubeClient) ListObjects(conf *rest.Config, unstructObj *unstructured.Un
 		return nil, err
 	}
 
-	list, err := client.Resource(resource).Namespace(namespace).List(context.TODO(), metav1.ListOptions{})
+	list, err := client.Resource(resource).Namespace(namespace).List(ctx, metav1.ListOptions{LabelSelector: selector})
 	if err != nil {
 		return nil, err
 	}
-	// todo: replace example code below
-	for _, d := range list.Items {
-		replicas, found, err := unstructured.NestedInt64(d.Object, "spec", "replicas")
-		if err != nil || !found {
-			fmt.Printf("Replicas not found for deployment %v: error=%v", d.GetName(), err)
+	return list.Items, nil
+}
+
+// DeleteObjectsByLabel deletes every object of a Kind in a namespace matching a label selector.
+// Objects are listed and deleted individually as not every resource supports deletecollection.
+// The number of objects deleted is returned along with any errors encountered.
+func (k *KubeClient) DeleteObjectsByLabel(ctx context.Context, gvk schema.GroupVersionKind, namespace string, selector string) (int, error) {
+	objs, err := k.ListObjects(ctx, gvk, namespace, selector)
+	if err != nil {
+		return 0, err
+	}
+	var errs []error
+	deleted := 0
+	for i := range objs {
+		err := k.DeleteObject(ctx, &objs[i], namespace)
+		if err != nil && !apierrors.IsNotFound(err) {
+			errs = append(errs, fmt.Errorf("delete %v %q: %w", gvk.Kind, objs[i].GetName(), err))
 			continue
 		}
-		fmt.Printf(" * %v (%d replicas)\n", d.GetName(), replicas)
+		deleted++
 	}
-	return nil, nil
+	return deleted, errors.Join(errs...)
 }
 
-func (k *KubeClient) GetObjectResource(unstructObj *unstructured.Unstructured) (schema.GroupVersionResource, error) {
-	c, err := discovery.NewDiscoveryClientForConfig(k.Config)
-	if err != nil {
-		return schema.GroupVersionResource{}, err
+// WaitForObjectsDeleted blocks until no object of a Kind in a namespace matches a label selector, or ctx is done.
+// Deletion is asynchronous, so objects may linger while finalizers run.
+func (k *KubeClient) WaitForObjectsDeleted(ctx context.Context, gvk schema.GroupVersionKind, namespace string, selector string) error {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		objs, err := k.ListObjects(ctx, gvk, namespace, selector)
+		if err != nil {
+			return err
+		}
+		if len(objs) == 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%v %v objects still present: %w", len(objs), gvk.Kind, ctx.Err())
+		case <-ticker.C:
+		}
+	}
+}
+
+var (
+	podResource = schema.GroupVersionResource{Version: "v1", Resource: "pods"}
+	// workloadResources are the controllers whose replicas must be ready, since their pods may not exist yet
+	workloadResources = []schema.GroupVersionResource{
+		{Group: "apps", Version: "v1", Resource: "deployments"},
+		{Group: "apps", Version: "v1", Resource: "statefulsets"},
+	}
+)
+
+// workloadReady reports whether the latest spec of a Deployment or StatefulSet has been observed and all of its replicas are ready.
+func workloadReady(d *unstructured.Unstructured) bool {
+	replicas, found, _ := unstructured.NestedInt64(d.Object, "spec", "replicas")
+	if !found {
+		replicas = 1
 	}
+	observed, _, _ := unstructured.NestedInt64(d.Object, "status", "observedGeneration")
+	ready, _, _ := unstructured.NestedInt64(d.Object, "status", "readyReplicas")
+	updated, _, _ := unstructured.NestedInt64(d.Object, "status", "updatedReplicas")
+	return observed >= d.GetGeneration() && updated >= replicas && ready >= replicas
+}
 
-	groupResources, err := restmapper.GetAPIGroupResources(c)
+// podReady reports whether a Pod has the Ready condition, or has run to completion.
+// Terminating pods are being replaced and are not waited for.
+func podReady(p *unstructured.Unstructured) bool {
+	if p.GetDeletionTimestamp() != nil {
+		return true
+	}
+	phase, _, _ := unstructured.NestedString(p.Object, "status", "phase")
+	if phase == "Succeeded" {
+		return true
+	}
+	conditions, _, _ := unstructured.NestedSlice(p.Object, "status", "conditions")
+	for _, c := range conditions {
+		cond, ok := c.(map[string]interface{})
+		if ok && cond["type"] == "Ready" {
+			return cond["status"] == "True"
+		}
+	}
+	return false
+}
+
+func allReady(ready map[string]bool) bool {
+	for _, r := range ready {
+		if !r {
+			return false
+		}
+	}
+	return true
+}
+
+// WaitForInstanceReady blocks until every Deployment and StatefulSet in a namespace matching a label selector has all
+// of its replicas ready and every matching Pod is ready, or ctx is done.
+func (k *KubeClient) WaitForInstanceReady(ctx context.Context, namespace string, selector string) error {
+	client, err := dynamic.NewForConfig(k.Config)
 	if err != nil {
-		return schema.GroupVersionResource{}, err
+		return err
+	}
+	for _, r := range workloadResources {
+		err := waitForReady(ctx, client.Resource(r).Namespace(namespace), selector, workloadReady)
+		if err != nil {
+			return fmt.Errorf("waiting for %v: %w", r.Resource, err)
+		}
+	}
+	err = waitForReady(ctx, client.Resource(podResource).Namespace(namespace), selector, podReady)
+	if err != nil {
+		return fmt.Errorf("waiting for pods: %w", err)
+	}
+	return nil
+}
+
+// waitForReady blocks until every object of a resource matching a label selector is ready, or ctx is done.
+// Objects are watched rather than polled; the watch is re-established if the apiserver closes it.
+func waitForReady(ctx context.Context, res dynamic.ResourceInterface, selector string, isReady func(*unstructured.Unstructured) bool) error {
+	for {
+		listCtx, cancel := requestContext(ctx)
+		list, err := res.List(listCtx, metav1.ListOptions{LabelSelector: selector})
+		cancel()
+		if err != nil {
+			return err
+		}
+		ready := make(map[string]bool, len(list.Items))
+		for i := range list.Items {
+			ready[list.Items[i].GetName()] = isReady(&list.Items[i])
+		}
+		if allReady(ready) {
+			return nil
+		}
+
+		w, err := res.Watch(ctx, metav1.ListOptions{LabelSelector: selector, ResourceVersion: list.GetResourceVersion()})
+		if err != nil {
+			return err
+		}
+		done, err := watchUntilReady(ctx, w, ready, isReady)
+		w.Stop()
+		if done || err != nil {
+			return err
+		}
+	}
+}
+
+// watchUntilReady updates ready from watch events until every object is ready.
+// It returns false without an error if the watch was closed before then.
+func watchUntilReady(ctx context.Context, w watch.Interface, ready map[string]bool, isReady func(*unstructured.Unstructured) bool) (bool, error) {
+	for {
+		select {
+		case <-ctx.Done():
+			return false, ctx.Err()
+		case ev, ok := <-w.ResultChan():
+			if !ok {
+				return false, nil
+			}
+			if ev.Type == watch.Error {
+				return false, apierrors.FromObject(ev.Object)
+			}
+			obj, ok := ev.Object.(*unstructured.Unstructured)
+			if !ok {
+				continue
+			}
+			if ev.Type == watch.Deleted {
+				delete(ready, obj.GetName())
+			} else {
+				ready[obj.GetName()] = isReady(obj)
+			}
+			if allReady(ready) {
+				return true, nil
+			}
+		}
+	}
+}
+
+func (k *KubeClient) GetObjectResource(ctx context.Context, unstructObj *unstructured.Unstructured) (schema.GroupVersionResource, error) {
+	return k.GetKindResource(ctx, unstructObj.GetObjectKind().GroupVersionKind())
+}
+
+// GetKindResource maps an object Kind to its Resource. The apiserver is only queried when the cache does not know
+// the Kind, in case its CRD was installed after the cache was filled, and then only for the resources of its version.
+func (k *KubeClient) GetKindResource(ctx context.Context, gvk schema.GroupVersionKind) (schema.GroupVersionResource, error) {
+	k.resources.mu.Lock()
+	resource, ok := k.resources.resources[gvk]
+	k.resources.mu.Unlock()
+	if ok {
+		return resource, nil
 	}
 
-	mapper := restmapper.NewDiscoveryRESTMapper(groupResources)
-	mapping, err := mapper.RESTMapping(unstructObj.GetObjectKind().GroupVersionKind().GroupKind())
+	ctx, cancel := requestContext(ctx)
+	defer cancel()
+	path := "/apis/" + gvk.GroupVersion().String()
+	if gvk.Group == "" {
+		path = "/api/" + gvk.Version
+	}
+	body, err := k.discovery.RESTClient().Get().AbsPath(path).Do(ctx).Raw()
+	if apierrors.IsNotFound(err) {
+		return schema.GroupVersionResource{}, &meta.NoKindMatchError{GroupKind: gvk.GroupKind(), SearchedVersions: []string{gvk.Version}}
+	}
 	if err != nil {
 		return schema.GroupVersionResource{}, err
 	}
+	var list metav1.APIResourceList
+	if err := json.Unmarshal(body, &list); err != nil {
+		return schema.GroupVersionResource{}, fmt.Errorf("could not parse resources of %v: %w", gvk.GroupVersion(), err)
+	}
 
-	return mapping.Resource, nil
+	k.resources.mu.Lock()
+	defer k.resources.mu.Unlock()
+	for _, r := range list.APIResources {
+		// Subresources such as pods/status share the Kind of their resource
+		if strings.Contains(r.Name, "/") {
+			continue
+		}
+		k.resources.resources[gvk.GroupVersion().WithKind(r.Kind)] = gvk.GroupVersion().WithResource(r.Name)
+	}
+	resource, ok = k.resources.resources[gvk]
+	if !ok {
+		return schema.GroupVersionResource{}, &meta.NoKindMatchError{GroupKind: gvk.GroupKind(), SearchedVersions: []string{gvk.Version}}
+	}
+	return resource, nil
+}
+
+// NewLeaseLock returns a lock on the Lease name in namespace held under identity, for use in leader election.
+func (k *KubeClient) NewLeaseLock(namespace string, name string, identity string) (resourcelock.Interface, error) {
+	client, err := coordinationv1client.NewForConfig(k.Config)
+	if err != nil {
+		return nil, err
+	}
+	return &resourcelock.LeaseLock{
+		LeaseMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: namespace,
+		},
+		Client: client,
+		LockConfig: resourcelock.ResourceLockConfig{
+			Identity: identity,
+		},
+	}, nil
 }
@@ -1,12 +1,15 @@
 package k8s
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
 
 	"strings"
 
 	"text/template"
+	"time"
 
 	"github.com/rs/zerolog"
 
@@ -15,6 +18,8 @@ import (
 	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/apimachinery/pkg/util/yaml"
 	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/tools/cache"
 )
 
 // UnmarshalSingleManifest unmarshals a single object in yaml string form.
@@ -59,61 +64,247 @@ func UnmarshalChallenges(challenges map[string]string) (map[string][]unstructure
 	return res, nil
 }
 
-func (k *KubeClient) QueryInstancedChallenges(ctx context.Context, namespace string) (map[string]*template.Template, error) {
-	log := zerolog.Ctx(ctx)
-	resource := schema.GroupVersionResource{
-		Group:    "k8s.maplebacon.org",
-		Version:  "unstable",
-		Resource: "instancedchallenges",
+// ChallengeDefinition is the parsed form of an InstancedChallenge CRD.
+type ChallengeDefinition struct {
+	Name string
+	// Generation is the generation of the CRD the definition was parsed from.
+	Generation int64
+	Template   *template.Template
+	// Expiry is the default lifetime of an instance, zero if unset.
+	Expiry time.Duration
+	// MaxExpiry is the maximum total lifetime of an instance, zero if unset.
+	MaxExpiry time.Duration
+	// Endpoints are the addresses exposed by an instance, in the order declared.
+	Endpoints []EndpointTemplate
+	// MaxInstances is the maximum number of active instances of the challenge across all teams, zero if unlimited.
+	MaxInstances int
+}
+
+// EndpointTemplate is a named template for an address exposed by an instance,
+// such as an https url or an nc connection string.
+type EndpointTemplate struct {
+	Name     string
+	Template *template.Template
+}
+
+// ChalInstIdentifier is the data available to challenge and endpoint templates.
+type ChalInstIdentifier struct {
+	ID        string
+	Challenge string
+	Namespace string
+}
+
+// parseEndpoints parses the optional spec.endpoints list of a CRD.
+func parseEndpoints(obj map[string]interface{}) ([]EndpointTemplate, error) {
+	endpoints, found, err := unstructured.NestedSlice(obj, "spec", "endpoints")
+	if err != nil || !found {
+		return nil, err
+	}
+	res := make([]EndpointTemplate, 0, len(endpoints))
+	for i, e := range endpoints {
+		endpoint, ok := e.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("endpoint %v is not an object", i)
+		}
+		name, _, err := unstructured.NestedString(endpoint, "name")
+		if err != nil {
+			return nil, fmt.Errorf("endpoint %v: %w", i, err)
+		}
+		tmplStr, found, err := unstructured.NestedString(endpoint, "template")
+		if err != nil || !found {
+			return nil, fmt.Errorf("endpoint %v: template not found: %v", i, err)
+		}
+		tmpl, err := template.New(name).Option("missingkey=error").Parse(tmplStr)
+		if err != nil {
+			return nil, fmt.Errorf("endpoint %v: %w", i, err)
+		}
+		res = append(res, EndpointTemplate{Name: name, Template: tmpl})
+	}
+	return res, nil
+}
+
+// parseDurationField parses an optional duration string at the given path of a CRD.
+// A missing field results in a zero duration.
+func parseDurationField(obj map[string]interface{}, fields ...string) (time.Duration, error) {
+	str, found, err := unstructured.NestedString(obj, fields...)
+	if err != nil || !found || str == "" {
+		return 0, err
+	}
+	d, err := time.ParseDuration(str)
+	if err != nil {
+		return 0, err
+	}
+	if d < 0 {
+		return 0, fmt.Errorf("negative duration %q", str)
+	}
+	return d, nil
+}
+
+// InstancedChallengeResource is the resource of the InstancedChallenge CRD.
+var InstancedChallengeResource = schema.GroupVersionResource{
+	Group:    "k8s.maplebacon.org",
+	Version:  "unstable",
+	Resource: "instancedchallenges",
+}
+
+// ErrChallengeHidden is returned when parsing a challenge which is marked as hidden.
+var ErrChallengeHidden = errors.New("challenge is hidden")
+
+// ParseInstancedChallenge parses and validates an InstancedChallenge object.
+// The challenge template is rendered once with a placeholder identifier to ensure it produces valid manifests.
+func ParseInstancedChallenge(c *unstructured.Unstructured) (ChallengeDefinition, error) {
+	hidden, found, err := unstructured.NestedBool(c.Object, "spec", "hidden")
+	if err != nil {
+		return ChallengeDefinition{}, fmt.Errorf("invalid hidden field: %w", err)
+	}
+	if found && hidden {
+		return ChallengeDefinition{}, ErrChallengeHidden
+	}
+	tmplStr, found, err := unstructured.NestedString(c.Object, "spec", "challengeTemplate")
+	if err != nil {
+		return ChallengeDefinition{}, fmt.Errorf("invalid challengeTemplate: %w", err)
+	}
+	if !found {
+		return ChallengeDefinition{}, errors.New("spec.challengeTemplate not found")
 	}
 
+	tmpl, err := template.New("challenge").Parse(tmplStr)
+	if err != nil {
+		return ChallengeDefinition{}, fmt.Errorf("could not parse challenge template: %w", err)
+	}
+	var objstr bytes.Buffer
+	err = tmpl.Execute(&objstr, ChalInstIdentifier{ID: "validate", Challenge: c.GetName(), Namespace: c.GetNamespace()})
+	if err != nil {
+		return ChallengeDefinition{}, fmt.Errorf("could not render challenge template: %w", err)
+	}
+	_, err = UnmarshalManifestFile(objstr.String())
+	if err != nil {
+		return ChallengeDefinition{}, fmt.Errorf("challenge template does not produce valid manifests: %w", err)
+	}
+	expiry, err := parseDurationField(c.Object, "spec", "expiry")
+	if err != nil {
+		return ChallengeDefinition{}, fmt.Errorf("could not parse expiry: %w", err)
+	}
+	maxExpiry, err := parseDurationField(c.Object, "spec", "maxExpiry")
+	if err != nil {
+		return ChallengeDefinition{}, fmt.Errorf("could not parse max expiry: %w", err)
+	}
+	endpoints, err := parseEndpoints(c.Object)
+	if err != nil {
+		return ChallengeDefinition{}, fmt.Errorf("could not parse endpoints: %w", err)
+	}
+	maxInstances, _, err := unstructured.NestedInt64(c.Object, "spec", "maxInstances")
+	if err != nil {
+		return ChallengeDefinition{}, fmt.Errorf("invalid maxInstances: %w", err)
+	}
+	if maxInstances < 0 {
+		return ChallengeDefinition{}, fmt.Errorf("maxInstances must not be negative, got %d", maxInstances)
+	}
+	return ChallengeDefinition{
+		Name:         c.GetName(),
+		Generation:   c.GetGeneration(),
+		Template:     tmpl,
+		Expiry:       expiry,
+		MaxExpiry:    maxExpiry,
+		Endpoints:    endpoints,
+		MaxInstances: int(maxInstances),
+	}, nil
+}
+
+// QueryInstancedChallenges parses the InstancedChallenges in a namespace, returning the valid definitions
+// and the names of the challenges which could not be parsed. Hidden challenges are in neither.
+func (k *KubeClient) QueryInstancedChallenges(ctx context.Context, namespace string) (map[string]ChallengeDefinition, []string, error) {
+	log := zerolog.Ctx(ctx)
+	ctx, cancel := requestContext(ctx)
+	defer cancel()
+
 	client, err := dynamic.NewForConfig(k.Config)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	chalList, err := client.Resource(resource).Namespace(namespace).List(ctx, metav1.ListOptions{})
+	chalList, err := client.Resource(InstancedChallengeResource).Namespace(namespace).List(ctx, metav1.ListOptions{})
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	ret := make(map[string]*template.Template)
+	ret := make(map[string]ChallengeDefinition)
+	rejected := make([]string, 0)
 
-	for _, c := range chalList.Items {
-		hidden, found, err := unstructured.NestedBool(c.Object, "spec", "hidden")
-		if err != nil || found && hidden {
-			log.Info().Err(err).Str("challenge", c.GetName()).Msg("skipping hidden challenge")
-			continue
-		}
-		tmplStr, found, err := unstructured.NestedString(c.Object, "spec", "challengeTemplate")
-		if err != nil || !found {
-			fmt.Printf("template not found for challenge crd %v: error=%v", c.GetName(), err)
+	for i := range chalList.Items {
+		c := &chalList.Items[i]
+		def, err := ParseInstancedChallenge(c)
+		if errors.Is(err, ErrChallengeHidden) {
+			log.Info().Str("challenge", c.GetName()).Msg("skipping hidden challenge")
 			continue
 		}
-
-		tmpl, err := template.New("challenge").Parse(tmplStr)
 		if err != nil {
-			log.Error().Err(err).Str("challenge", c.GetName()).Msg("could not parse a challenge template")
+			log.Error().Err(err).Str("challenge", c.GetName()).Msg("could not parse a challenge")
+			rejected = append(rejected, c.GetName())
 			continue
 		}
-		ret[c.GetName()] = tmpl
+		ret[c.GetName()] = def
 	}
-	return ret, nil
+	return ret, rejected, nil
 }
 
-func (k *KubeClient) QueryInstancedChallenge(ctx context.Context, name string, namespace string) ([]unstructured.Unstructured, error) {
-	resource := schema.GroupVersionResource{
-		Group:    "k8s.maplebacon.org",
-		Version:  "unstable",
-		Resource: "instancedchallenges",
+// NewInstancedChallengeInformer returns an informer watching the InstancedChallenges in a namespace.
+// The informer is not started.
+func (k *KubeClient) NewInstancedChallengeInformer(namespace string, resync time.Duration) (cache.SharedIndexInformer, error) {
+	client, err := dynamic.NewForConfig(k.Config)
+	if err != nil {
+		return nil, err
+	}
+	factory := dynamicinformer.NewFilteredDynamicSharedInformerFactory(client, resync, namespace, nil)
+	return factory.ForResource(InstancedChallengeResource).Informer(), nil
+}
+
+// ChallengeStatus is the status subresource of an InstancedChallenge.
+type ChallengeStatus struct {
+	Valid              bool
+	Message            string
+	ObservedGeneration int64
+}
+
+// UpdateInstancedChallengeStatus writes status to the status subresource of an InstancedChallenge,
+// unless the object already has that status.
+func (k *KubeClient) UpdateInstancedChallengeStatus(ctx context.Context, c *unstructured.Unstructured, status ChallengeStatus) error {
+	valid, _, _ := unstructured.NestedBool(c.Object, "status", "valid")
+	message, _, _ := unstructured.NestedString(c.Object, "status", "message")
+	generation, found, _ := unstructured.NestedInt64(c.Object, "status", "observedGeneration")
+	if found && valid == status.Valid && message == status.Message && generation == status.ObservedGeneration {
+		return nil
 	}
 
+	ctx, cancel := requestContext(ctx)
+	defer cancel()
+	client, err := dynamic.NewForConfig(k.Config)
+	if err != nil {
+		return err
+	}
+
+	obj := c.DeepCopy()
+	err = unstructured.SetNestedMap(obj.Object, map[string]interface{}{
+		"valid":              status.Valid,
+		"message":            status.Message,
+		"observedGeneration": status.ObservedGeneration,
+	}, "status")
+	if err != nil {
+		return err
+	}
+	_, err = client.Resource(InstancedChallengeResource).Namespace(obj.GetNamespace()).UpdateStatus(ctx, obj, metav1.UpdateOptions{})
+	return err
+}
+
+func (k *KubeClient) QueryInstancedChallenge(ctx context.Context, name string, namespace string) ([]unstructured.Unstructured, error) {
+	ctx, cancel := requestContext(ctx)
+	defer cancel()
 	client, err := dynamic.NewForConfig(k.Config)
 	if err != nil {
 		return nil, err
 	}
 
-	chal, err := client.Resource(resource).Namespace(namespace).Get(ctx, name, metav1.GetOptions{})
+	chal, err := client.Resource(InstancedChallengeResource).Namespace(namespace).Get(ctx, name, metav1.GetOptions{})
 	if err != nil {
 		return nil, err
 	}